@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+
+	"golang.org/x/oauth2"
+)
+
+// exitTokenExpired is the exit status when the token can no longer be
+// refreshed and the user has to authorize again, so wrappers can tell it
+// apart from failed downloads.
+const exitTokenExpired = 3
+
+// isTokenExpired reports whether err is the authorization server turning
+// down a token refresh, which happens once the refresh token has expired or
+// been revoked. Retrying cannot fix it.
+func isTokenExpired(err error) bool {
+	var re *oauth2.RetrieveError
+	if !errors.As(err, &re) {
+		return false
+	}
+	return re.ErrorCode == "invalid_grant" || re.ErrorCode == "unauthorized_client" ||
+		(re.Response != nil && (re.Response.StatusCode == http.StatusBadRequest || re.Response.StatusCode == http.StatusUnauthorized))
+}
+
+// backupToken moves an invalid token file aside to <file>.invalid, so it is
+// not picked up again and can still be inspected.
+func backupToken(tokFile string) {
+	backup := tokFile + ".invalid"
+	if err := os.Rename(tokFile, backup); err != nil {
+		log.Printf("Unable to move the invalid token aside: %v", err)
+		return
+	}
+	log.Printf("Moved the invalid token to %s", backup)
+}
+
+// reauthorize replaces a token that can no longer be refreshed. With a
+// terminal the web flow is run again on it, as stdin carries the input;
+// without one the run exits with exitTokenExpired.
+func reauthorize(config *oauth2.Config, tokFile string) *oauth2.Token {
+	backupToken(tokFile)
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		log.Print("The saved token has expired or was revoked, run gdrive-dl interactively to authorize it again")
+		os.Exit(exitTokenExpired)
+	}
+	defer tty.Close()
+	fmt.Fprintln(tty, "The saved token has expired or was revoked, authorize gdrive-dl again.")
+	tok := getTokenFromWeb(config, tty, tty)
+	saveToken(tokFile, tok)
+	return tok
+}
+
+// checkToken refreshes tok up front if it needs it, so a dead refresh token
+// is caught before any download starts rather than deep inside one.
+func checkToken(config *oauth2.Config, tok *oauth2.Token) error {
+	_, err := config.TokenSource(context.Background(), tok).Token()
+	return err
+}
+
+// tokenWatchTransport notices a token refresh failing during the run and
+// calls expired once, since every request after it would fail the same
+// way.
+type tokenWatchTransport struct {
+	base    http.RoundTripper
+	expired func()
+	once    sync.Once
+}
+
+func (t *tokenWatchTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err != nil && isTokenExpired(err) {
+		t.once.Do(t.expired)
+	}
+	return resp, err
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+// isUnavailable reports whether err is a file not being found or not
+// accessible, which right after it was shared may only be the share not
+// having propagated yet. Rate limits and download quotas, which come as
+// 403s too, are not.
+func isUnavailable(err error) bool {
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) || isRetryable(err) || isDownloadQuotaExceeded(err) {
+		return false
+	}
+	return apiErr.Code == http.StatusNotFound || apiErr.Code == http.StatusForbidden
+}
+
+// awaitAvailability calls fn again, with backoff, while it fails with
+// errors isUnavailable accepts, for up to --wait-for-availability after
+// the first failure err. The last error is returned once the time is up.
+func (d *downloader) awaitAvailability(ctx context.Context, fileID string, err error, fn func() error) error {
+	deadline := time.Now().Add(d.waitAvailable)
+	log.Printf("%s: not available (%v), waiting up to %v for it to be shared", fileID, err, d.waitAvailable)
+	for attempt := 0; ; attempt++ {
+		delay := min(backoff(attempt), time.Until(deadline))
+		if delay <= 0 {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		if err = fn(); !isUnavailable(err) {
+			return err
+		}
+	}
+}
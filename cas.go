@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"google.golang.org/api/drive/v3"
+)
+
+// casStore keeps each distinct file content once, under
+// objects/<first two md5 digits>/<md5>, and records which logical path maps
+// to which object in an md5sum-style manifest.
+type casStore struct {
+	dir string
+
+	mu       sync.Mutex
+	manifest *os.File
+}
+
+// openCASStore prepares the store layout in dir and opens its manifest for
+// appending, creating them with dirMode and fileMode.
+func openCASStore(dir string, fileMode, dirMode os.FileMode) (*casStore, error) {
+	if err := os.MkdirAll(filepath.Join(dir, "tmp"), dirMode); err != nil {
+		return nil, fmt.Errorf("unable to create store: %v", err)
+	}
+	f, err := os.OpenFile(filepath.Join(dir, "manifest.md5"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, fileMode)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open store manifest: %v", err)
+	}
+	return &casStore{dir: dir, manifest: f}, nil
+}
+
+// objectPath returns where the object with the given md5 lives.
+func (c *casStore) objectPath(sum string) string {
+	return filepath.Join(c.dir, "objects", sum[:2], sum)
+}
+
+// record appends a "<md5>  <path>" line to the manifest.
+func (c *casStore) record(sum, path string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, err := fmt.Fprintf(c.manifest, "%s  %s\n", sum, filepath.ToSlash(path)); err != nil {
+		return fmt.Errorf("unable to write store manifest: %v", err)
+	}
+	return nil
+}
+
+// Close closes the manifest.
+func (c *casStore) Close() error {
+	return c.manifest.Close()
+}
+
+// saveObject stores file in the content-addressed store under dest's
+// logical path. When Drive knows the md5 and the object already exists
+// nothing is downloaded. Exports have no md5 on Drive, so they are always
+// downloaded and hashed locally before being deduplicated. The returned path
+// is the object's.
+func (d *downloader) saveObject(ctx context.Context, file *drive.File, dest string) (saved, error) {
+	c := d.cas
+	if sum := file.Md5Checksum; sum != "" {
+		if _, err := os.Stat(c.objectPath(sum)); err == nil {
+			log.Printf("%s: %s is already stored as %s", file.Id, dest, sum)
+			d.stats.skipped.Add(1)
+			return saved{path: c.objectPath(sum), skipped: true}, c.record(sum, dest)
+		}
+	}
+
+	tmp := filepath.Join(c.dir, "tmp", file.Id)
+	t := d.stats.begin(file, dest)
+	t.progress = d.progress
+	defer d.stats.end(t)
+	var written int64
+	var sum string
+	for attempt := 0; ; attempt++ {
+		var err error
+		if written, err = d.fetch(ctx, file, tmp, t); err != nil {
+			return saved{}, err
+		}
+		if sum, err = fileMD5(tmp); err != nil {
+			os.Remove(tmp)
+			return saved{}, err
+		}
+		if file.Md5Checksum == "" || sum == file.Md5Checksum {
+			break
+		}
+		os.Remove(tmp)
+		err = &checksumError{got: sum, want: file.Md5Checksum}
+		retries := d.redownloads(err)
+		if attempt >= retries {
+			return saved{}, err
+		}
+		log.Printf("%s: %v, downloading again (%d/%d)", file.Id, err, attempt+1, retries)
+	}
+
+	obj := c.objectPath(sum)
+	if _, err := os.Stat(obj); err == nil {
+		os.Remove(tmp)
+	} else {
+		if err := os.MkdirAll(filepath.Dir(obj), d.dirMode); err != nil {
+			os.Remove(tmp)
+			return saved{}, fmt.Errorf("unable to create store folder: %v", err)
+		}
+		if err := os.Rename(tmp, obj); err != nil {
+			os.Remove(tmp)
+			return saved{}, fmt.Errorf("unable to move object into the store: %v", err)
+		}
+	}
+	d.stats.completed.Add(1)
+	return saved{path: obj, bytes: written}, c.record(sum, dest)
+}
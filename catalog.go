@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// catalogHeader is the first row of the --catalog CSV.
+var catalogHeader = []string{"id", "name", "path", "size", "md5", "mime_type", "owner", "modified_time", "status", "error"}
+
+// writeCatalog writes a spreadsheet friendly CSV with one row per file in
+// the report, failed ones included and marked by their status.
+func (r *report) writeCatalog(path string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("unable to write catalog: %v", err)
+	}
+	w := csv.NewWriter(f)
+	w.Write(catalogHeader)
+	for _, res := range r.results {
+		var size, md5, mimeType, owner, modified string
+		if file := res.file; file != nil {
+			if !isNative(file) {
+				size = strconv.FormatInt(file.Size, 10)
+				if humanCatalogBytes {
+					size = humanBytes(file.Size)
+				}
+			}
+			md5, mimeType, modified = file.Md5Checksum, file.MimeType, file.ModifiedTime
+			if len(file.Owners) > 0 {
+				owner = file.Owners[0].EmailAddress
+			}
+		}
+		w.Write([]string{res.ID, res.Name, res.Path, size, md5, mimeType, owner, modified, res.Status, res.Error})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		f.Close()
+		return fmt.Errorf("unable to write catalog: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("unable to write catalog: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Collision strategies for files that resolve to the same output path.
+const (
+	collisionOverwrite = "overwrite"
+	collisionRename    = "rename"
+	collisionHash      = "hash"
+)
+
+// collisions hands out output paths so that two different files in the same
+// run never write to the same place. Paths are only tracked within a run:
+// files left on disk by an earlier run are expected to be overwritten.
+type collisions struct {
+	mu       sync.Mutex
+	strategy string
+	claimed  map[string]string // output path -> file ID
+}
+
+// newCollisions validates the --collision strategy.
+func newCollisions(strategy string) (*collisions, error) {
+	switch strategy {
+	case collisionOverwrite, collisionRename, collisionHash:
+	default:
+		return nil, fmt.Errorf("unknown collision strategy %q, expected overwrite, rename or hash", strategy)
+	}
+	return &collisions{strategy: strategy, claimed: map[string]string{}}, nil
+}
+
+// claim returns the path fileID should be written to. With rename the
+// first file keeps dest and later ones get " (1)", " (2)"..., which depends
+// on the order files arrive in. With hash every file gets a short hash of
+// its ID, whether or not another one shares its name, so each ID maps to
+// the same path on every run.
+func (c *collisions) claim(fileID, dest string) string {
+	switch c.strategy {
+	case collisionOverwrite:
+		return dest
+	case collisionHash:
+		return withSuffix(dest, "."+idHash(fileID))
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	candidate := dest
+	for i := 1; ; i++ {
+		owner, taken := c.claimed[candidate]
+		if !taken || owner == fileID {
+			c.claimed[candidate] = fileID
+			return candidate
+		}
+		candidate = withSuffix(dest, fmt.Sprintf(" (%d)", i))
+	}
+}
+
+// withSuffix inserts suffix between a path's base name and its extension.
+func withSuffix(path, suffix string) string {
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + suffix + ext
+}
+
+// idHash returns a short, stable hash of a file ID.
+func idHash(fileID string) string {
+	sum := sha256.Sum256([]byte(fileID))
+	return hex.EncodeToString(sum[:3])
+}
@@ -0,0 +1,26 @@
+package main
+
+import "testing"
+
+func TestHashCollisionsIgnoreOrder(t *testing.T) {
+	names := func(ids ...string) map[string]string {
+		c, err := newCollisions(collisionHash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := map[string]string{}
+		for _, id := range ids {
+			got[id] = c.claim(id, "report.pdf")
+		}
+		return got
+	}
+	first, second := names("a1", "b2"), names("b2", "a1")
+	for _, id := range []string{"a1", "b2"} {
+		if first[id] != second[id] {
+			t.Errorf("%s is named %s or %s depending on the order", id, first[id], second[id])
+		}
+	}
+	if first["a1"] == first["b2"] {
+		t.Errorf("both files are named %s", first["a1"])
+	}
+}
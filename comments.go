@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"google.golang.org/api/drive/v3"
+)
+
+// commentFields selects the comment data worth keeping, including replies.
+const commentFields = "nextPageToken,comments(id,author(displayName,emailAddress),content,htmlContent," +
+	"createdTime,modifiedTime,resolved,deleted,quotedFileContent,anchor," +
+	"replies(id,author(displayName,emailAddress),content,htmlContent,createdTime,modifiedTime,action,deleted))"
+
+// commentsSidecarExt is appended to a download's path for its
+// --export-comments sidecar.
+const commentsSidecarExt = ".comments.json"
+
+// saveComments writes every comment on a file, with its replies, to path as
+// JSON. Nothing is written when the file has no comments.
+func (d *downloader) saveComments(ctx context.Context, fileID, path string) error {
+	var comments []*drive.Comment
+	err := d.retry.do(ctx, fileID, func() error {
+		comments = nil
+		return d.srv.Comments.List(fileID).Fields(commentFields).PageSize(100).
+			Pages(ctx, func(page *drive.CommentList) error {
+				comments = append(comments, page.Comments...)
+				return nil
+			})
+	})
+	if err != nil {
+		return fmt.Errorf("unable to list comments: %v", err)
+	}
+	if len(comments) == 0 {
+		return nil
+	}
+
+	f, err := d.create(path)
+	if err != nil {
+		return fmt.Errorf("unable to create comments file: %v", err)
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(comments); err != nil {
+		f.Close()
+		os.Remove(path)
+		return fmt.Errorf("unable to write comments: %v", err)
+	}
+	return f.Close()
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/oauth2"
+)
+
+// Environment variables holding the client secret and the token as raw
+// JSON, for environments where secrets are injected rather than mounted.
+// When set they take precedence over the files.
+const (
+	credentialsEnv = "GDRIVE_CREDENTIALS_JSON"
+	tokenEnv       = "GDRIVE_TOKEN_JSON"
+)
+
+// lookupJSONEnv returns the value of a JSON environment variable, and
+// whether it is set. A variable that is set must not be empty.
+func lookupJSONEnv(name string) ([]byte, bool, error) {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return nil, false, nil
+	}
+	if v == "" {
+		return nil, true, fmt.Errorf("%s is set but empty", name)
+	}
+	if !json.Valid([]byte(v)) {
+		return nil, true, fmt.Errorf("%s does not contain valid JSON", name)
+	}
+	return []byte(v), true, nil
+}
+
+// loadCredentials returns the client secret JSON, from $GDRIVE_CREDENTIALS_JSON
+// or else ~/.credentials.json.
+func loadCredentials() ([]byte, error) {
+	b, ok, err := lookupJSONEnv(credentialsEnv)
+	if ok {
+		return b, err
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get home directory: %v", err)
+	}
+	b, err = os.ReadFile(filepath.Join(home, ".credentials.json"))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read client secret file: %v", err)
+	}
+	return b, nil
+}
+
+// tokenFromEnv returns the token in $GDRIVE_TOKEN_JSON, if it is set. Such
+// a token is never written to disk, not even once refreshed, and it must
+// carry the scope the run needs.
+func tokenFromEnv() (*oauth2.Token, bool, error) {
+	b, ok, err := lookupJSONEnv(tokenEnv)
+	if !ok || err != nil {
+		return nil, ok, err
+	}
+	tok := &oauth2.Token{}
+	if err := json.Unmarshal(b, tok); err != nil {
+		return nil, true, fmt.Errorf("%s is not a valid token: %v", tokenEnv, err)
+	}
+	if tok.AccessToken == "" && tok.RefreshToken == "" {
+		return nil, true, fmt.Errorf("%s has neither an access nor a refresh token", tokenEnv)
+	}
+	return tok, true, nil
+}
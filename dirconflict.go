@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Policies for a folder in the output path that already exists as a file.
+const (
+	dirConflictError  = "error"
+	dirConflictRename = "rename"
+)
+
+// dirConflictSuffix is appended to a folder name that is taken by a file.
+const dirConflictSuffix = "_dir"
+
+// parseDirConflict validates an --on-dir-conflict value.
+func parseDirConflict(policy string) (string, error) {
+	switch policy {
+	case dirConflictError, dirConflictRename:
+		return policy, nil
+	}
+	return "", fmt.Errorf("unknown --on-dir-conflict %q, expected error or rename", policy)
+}
+
+// makeParentDirs creates the folders leading to dest and returns the path
+// the file should be written to. A Drive folder and a file can share a name
+// side by side, so a folder component may already exist as a regular file.
+// That is either reported, or the folder is renamed to <name>_dir.
+func (d *downloader) makeParentDirs(dest string) (string, error) {
+	dir, name := filepath.Split(dest)
+	if dir == "" {
+		return dest, nil
+	}
+
+	// An absolute dir, as under an absolute --exports-dir, keeps its volume
+	// and root; only the folder names after them are checked.
+	var resolved string
+	rest := filepath.Clean(dir)
+	if filepath.IsAbs(rest) {
+		vol := filepath.VolumeName(rest)
+		resolved = vol + string(filepath.Separator)
+		rest = strings.TrimPrefix(rest[len(vol):], string(filepath.Separator))
+	}
+	for _, part := range strings.Split(rest, string(filepath.Separator)) {
+		if part == "" {
+			continue
+		}
+		candidate := filepath.Join(resolved, part)
+		for {
+			info, err := os.Stat(candidate)
+			if err != nil || info.IsDir() {
+				break
+			}
+			if d.onDirConflict != dirConflictRename {
+				return "", fmt.Errorf("cannot create folder %s, a file with that name already exists (use --on-dir-conflict=rename to write into %s%s instead)", candidate, candidate, dirConflictSuffix)
+			}
+			candidate += dirConflictSuffix
+		}
+		resolved = candidate
+	}
+	if err := os.MkdirAll(resolved, d.dirMode); err != nil {
+		return "", diskErrorf(err, "unable to create destination folder %s: %v", resolved, err)
+	}
+	return filepath.Join(resolved, name), nil
+}
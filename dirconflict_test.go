@@ -0,0 +1,49 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMakeParentDirsAbsolute(t *testing.T) {
+	t.Chdir(t.TempDir())
+	root := t.TempDir()
+	d := &downloader{dirMode: 0755, onDirConflict: dirConflictRename}
+
+	dest := filepath.Join(root, "exports", "Notes.pdf")
+	got, err := d.makeParentDirs(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != dest {
+		t.Errorf("writing to %s, want %s", got, dest)
+	}
+	if info, err := os.Stat(filepath.Dir(dest)); err != nil || !info.IsDir() {
+		t.Errorf("%s was not created: %v", filepath.Dir(dest), err)
+	}
+	if entries, _ := os.ReadDir("."); len(entries) != 0 {
+		t.Errorf("created %d entries under the working directory", len(entries))
+	}
+}
+
+func TestMakeParentDirsRenamesFileConflict(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "A"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	d := &downloader{dirMode: 0755, onDirConflict: dirConflictRename}
+
+	got, err := d.makeParentDirs(filepath.Join(root, "A", "B", "file.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(root, "A"+dirConflictSuffix, "B", "file.txt"); got != want {
+		t.Errorf("writing to %s, want %s", got, want)
+	}
+
+	d.onDirConflict = dirConflictError
+	if _, err := d.makeParentDirs(filepath.Join(root, "A", "file.txt")); err == nil {
+		t.Error("conflict with a file was not reported")
+	}
+}
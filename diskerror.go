@@ -0,0 +1,49 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+)
+
+// What --on-disk-error does when writing to the local filesystem fails.
+const (
+	onDiskErrorSkip  = "skip"
+	onDiskErrorAbort = "abort"
+)
+
+// exitDiskError is the exit status when --on-disk-error=abort stopped the
+// run.
+const exitDiskError = 5
+
+func parseOnDiskError(s string) (string, error) {
+	switch s {
+	case onDiskErrorSkip, onDiskErrorAbort:
+		return s, nil
+	}
+	return "", fmt.Errorf("invalid --on-disk-error %q, expected %s or %s", s, onDiskErrorSkip, onDiskErrorAbort)
+}
+
+// diskError is a failure of the local filesystem rather than of Drive or
+// the network, such as a full disk, a read-only or vanished mount, or
+// missing permissions. Unlike API errors it usually affects every file.
+type diskError struct {
+	err error
+}
+
+func (e *diskError) Error() string { return e.err.Error() }
+func (e *diskError) Unwrap() error { return e.err }
+
+// diskErrorf formats an error like fmt.Errorf, and marks it as a diskError
+// when its cause comes from the filesystem. The cause has to be looked at
+// before it is formatted, as %v does not keep it.
+func diskErrorf(cause error, format string, a ...any) error {
+	err := fmt.Errorf(format, a...)
+	var pathErr *fs.PathError
+	var linkErr *os.LinkError
+	if errors.As(cause, &pathErr) || errors.As(cause, &linkErr) {
+		return &diskError{err}
+	}
+	return err
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// diskPollInterval is how often free space is re-checked while paused.
+const diskPollInterval = 5 * time.Second
+
+// diskGuard holds back new downloads while a filesystem downloads are
+// written to has less than minFree bytes available, and gives up once low
+// space has lasted timeout.
+type diskGuard struct {
+	mu sync.Mutex
+	// dirs are the output folders checked: the working directory, and the
+	// --staging-dir, --exports-dir and --cas-store ones.
+	dirs    []string
+	minFree int64
+	timeout time.Duration
+	// deadline ends the current pause, shared by every download waiting
+	// on it; it is zero while there is enough space.
+	deadline time.Time
+}
+
+// newDiskGuard returns a guard over dirs, leaving out the empty ones.
+func newDiskGuard(minFree int64, timeout time.Duration, dirs ...string) *diskGuard {
+	g := &diskGuard{minFree: minFree, timeout: timeout}
+	for _, dir := range dirs {
+		if dir != "" {
+			g.dirs = append(g.dirs, dir)
+		}
+	}
+	return g
+}
+
+// wait returns once there is enough free space to start another download.
+// Only one caller polls at a time; the others queue behind it, so a low disk
+// pauses every new download without piling up checks. The pause has one
+// deadline however many downloads wait on it.
+func (g *diskGuard) wait(ctx context.Context) error {
+	if g == nil || g.minFree <= 0 {
+		return nil
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for {
+		dir, free, err := g.lowest()
+		if err != nil {
+			return fmt.Errorf("unable to check free disk space: %v", err)
+		}
+		if free >= g.minFree {
+			if !g.deadline.IsZero() {
+				log.Printf("Free disk space is back to %s, resuming downloads", logBytes(free))
+				g.deadline = time.Time{}
+			}
+			return nil
+		}
+		if g.deadline.IsZero() {
+			log.Printf("Warning: only %s free in %s, pausing new downloads until %s are available", logBytes(free), dir, logBytes(g.minFree))
+			g.deadline = time.Now().Add(g.timeout)
+		}
+		if time.Now().After(g.deadline) {
+			return fmt.Errorf("only %s free in %s, below --min-free-space, after waiting %v", logBytes(free), dir, g.timeout)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(diskPollInterval):
+		}
+	}
+}
+
+// lowest returns the folder of g.dirs with the least free space, and how
+// much it has. A folder not created yet is checked through the nearest one
+// above it that exists.
+func (g *diskGuard) lowest() (string, int64, error) {
+	var lowDir string
+	low := int64(-1)
+	for _, dir := range g.dirs {
+		existing := filepath.Clean(dir)
+		for {
+			if _, err := os.Stat(existing); err == nil {
+				break
+			}
+			parent := filepath.Dir(existing)
+			if parent == existing {
+				break
+			}
+			existing = parent
+		}
+		free, err := freeSpace(existing)
+		if err != nil {
+			return "", 0, err
+		}
+		if low < 0 || free < low {
+			lowDir, low = dir, free
+		}
+	}
+	return lowDir, low, nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux && !darwin
+
+package main
+
+import "errors"
+
+// freeSpace is not implemented on this platform.
+func freeSpace(dir string) (int64, error) {
+	return 0, errors.New("free space checks are not supported on this platform")
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDiskGuardSharesOneTimeout(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := freeSpace(dir); err != nil {
+		t.Skip(err)
+	}
+	// Not created yet, so checked through dir.
+	g := newDiskGuard(1<<62, time.Hour, "", filepath.Join(dir, "exports", "A"))
+	// A pause that began an hour ago, while other downloads waited.
+	g.deadline = time.Now().Add(-time.Second)
+
+	done := make(chan error, 1)
+	go func() { done <- g.wait(context.Background()) }()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("started a download below --min-free-space")
+		}
+	case <-time.After(diskPollInterval / 2):
+		t.Fatal("a queued download waited out a timeout of its own")
+	}
+}
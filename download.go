@@ -0,0 +1,530 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/sheets/v4"
+)
+
+// downloader holds the Drive client and the settings shared by every download.
+type downloader struct {
+	srv     *drive.Service
+	client  *http.Client
+	parents *parentCache
+	// sheets is set with --sheets-per-tab.
+	sheets         *sheets.Service
+	exportComments bool
+	normalize      func(string) string
+	namer          namer
+	noPath         bool
+	exportsDir     string
+	strictSize     bool
+	trashAfter     bool
+	collisions     *collisions
+	organizeShared bool
+	skipExisting   bool
+	skipMatch      string
+	stagingDir     string
+	stats          *stats
+	onDirConflict  string
+	extraFields    []string
+	verifyOnly     bool
+	dryRun         bool
+	cas            *casStore
+	retry          retrier
+	buffers        *sync.Pool
+	exportAs       map[string]exportFormat
+	exportOptions  map[string]url.Values
+	exportByID     map[string]exportFormat
+	catalog        bool
+	indexed        bool
+	verifyMD5      bool
+	retryMismatch  bool
+	listScope      listScope
+	chmod          os.FileMode
+	// newFileMode and dirMode are the permissions output files and folders
+	// are created with, before the umask.
+	newFileMode    os.FileMode
+	dirMode        os.FileMode
+	readonlyIfView bool
+	gunzip         bool
+	gzip           bool
+	// downloadAs is the MIME type --download-as treats the input files as,
+	// and downloadAsByID the ones --input-json entries ask for.
+	downloadAs     string
+	downloadAsByID map[string]string
+	// templated names files with --dir-template or --name-template, which
+	// need owners and times.
+	templated bool
+	// modifiedAfter, if set, skips files last modified before it.
+	modifiedAfter time.Time
+	// parts is how many ranges --parallel-file-parts downloads files of at
+	// least partsMinSize bytes in, 0 or 1 meaning one stream.
+	parts        int
+	partsMinSize int64
+	// mirror, with --dry-run or --delete-extraneous, is told every path
+	// written, so none of them is taken for extraneous.
+	mirror *mirror
+	// partials are the partial downloads found when the run started.
+	partials *partialSet
+	// streamHashes are the checksums --stream-hash computes as downloads
+	// are written.
+	streamHashes []string
+	// acknowledgeAbuse downloads files Drive flags as abusive.
+	acknowledgeAbuse bool
+	// mimeRoutes, from --mime-route, put files into a directory by type.
+	mimeRoutes []mimeRoute
+	// driveIDs fetches every file's driveId even with --no-path, for
+	// --concurrency-per-drive.
+	driveIDs bool
+	// waitAvailable is how long files that are not found or not accessible
+	// are waited for, as a share may take a moment to propagate.
+	waitAvailable time.Duration
+	// onEmptyFile is what --on-empty-file does with zero-byte files.
+	onEmptyFile string
+	// keepPartial keeps failed transfers as <dest>.partial, to be resumed
+	// by the next run.
+	keepPartial bool
+	// sink, when set, receives the downloads instead of the local output
+	// tree, for --sink.
+	sink sink
+	// orderBy sorts folder listings and lookups, for a reproducible order.
+	orderBy string
+	// quotaCopies is set with --copy-on-quota-block.
+	quotaCopies *quotaCopies
+	// progress is passed on to every transfer, for --progress-log and
+	// embedders that render their own progress.
+	progress progressFunc
+}
+
+// newBufferPool returns a pool of copy buffers of the given size, shared by
+// all downloads to keep allocations flat at high concurrency.
+func newBufferPool(size int) *sync.Pool {
+	return &sync.Pool{New: func() any {
+		b := make([]byte, size)
+		return &b
+	}}
+}
+
+// countingWriter reports written bytes to the transfer's progress. Being a
+// plain Writer, it also hides an *os.File's ReadFrom so io.CopyBuffer really
+// goes through the pooled buffer.
+type countingWriter struct {
+	w io.Writer
+	t *transfer
+}
+
+func (c countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.t.hashWrite(p[:n])
+	c.t.add(int64(n))
+	return n, err
+}
+
+// saved describes what save did with a file.
+type saved struct {
+	path    string // where the file ended up, after any folder renames
+	bytes   int64
+	skipped bool
+	trashed bool
+}
+
+// save writes a resolved file to dest, unless it was not modified since
+// --modified-after or --skip-existing finds it is already there.
+func (d *downloader) save(ctx context.Context, file *drive.File, dest string) (saved, error) {
+	if d.unchangedSince(file) {
+		log.Printf("%s: %s was not modified since %s, skipping", file.Id, dest, d.modifiedAfter.Format(time.RFC3339))
+		d.stats.skipped.Add(1)
+		return saved{path: dest, skipped: true}, nil
+	}
+	if d.sheets != nil && file.MimeType == spreadsheetMimeType {
+		return d.saveSheetTabs(ctx, file, dest)
+	}
+	if isEmptyFile(file) {
+		switch d.onEmptyFile {
+		case onEmptySkip:
+			log.Printf("%s: %s is empty on Drive, skipping", file.Id, dest)
+			d.stats.skipped.Add(1)
+			return saved{path: dest, skipped: true}, nil
+		case onEmptyWarnFile:
+			log.Printf("Warning: %s: %s is empty on Drive, the content may be missing upstream", file.Id, dest)
+		}
+	}
+	if d.cas != nil {
+		return d.saveObject(ctx, file, dest)
+	}
+	if d.sink != nil {
+		return d.saveToSink(ctx, file, dest)
+	}
+	if d.skipExisting && d.alreadyPresent(file, dest) {
+		log.Printf("%s: %s already exists, skipping", file.Id, dest)
+		d.stats.skipped.Add(1)
+		return saved{path: dest, skipped: true}, nil
+	}
+	return d.saveContent(ctx, file, dest)
+}
+
+// saveContent downloads a resolved file to dest. A partially written file is
+// removed if the transfer fails.
+func (d *downloader) saveContent(ctx context.Context, file *drive.File, dest string) (saved, error) {
+	fileID := file.Id
+	dest, err := d.makeParentDirs(dest)
+	if err != nil {
+		return saved{}, err
+	}
+	res := saved{path: dest}
+
+	if len(d.extraFields) > 0 {
+		if err := d.writeMetadataSidecar(file, dest+metadataSidecarExt); err != nil {
+			return res, err
+		}
+		d.mirror.keepPath(dest + metadataSidecarExt)
+	}
+
+	// Comments are saved before the content so they are kept even for files
+	// whose bytes cannot be downloaded. Missing them is not worth failing
+	// the file over.
+	if d.exportComments {
+		if err := d.saveComments(ctx, fileID, dest+commentsSidecarExt); err != nil {
+			log.Printf("Warning: %s: %v", fileID, err)
+		} else {
+			d.mirror.keepPath(dest + commentsSidecarExt)
+		}
+	}
+
+	// With a staging directory the file is completed and checked there, and
+	// only renamed into the output tree once it is known to be good.
+	target := dest
+	if d.stagingDir != "" {
+		target = filepath.Join(d.stagingDir, fileID)
+	}
+	t := d.stats.begin(file, dest)
+	t.progress = d.progress
+	t.startHashes(d.hashNames())
+	t.showHashes = len(d.streamHashes) > 0
+	defer d.stats.end(t)
+	for attempt := 0; ; attempt++ {
+		written, err := d.fetch(ctx, file, target, t)
+		if err != nil {
+			return res, err
+		}
+		err = d.checkSize(file, dest, written)
+		if err == nil {
+			err = d.checkMD5(file, target, t)
+		}
+		if err == nil {
+			if err := d.applyMode(file, target); err != nil {
+				os.Remove(target)
+				return res, err
+			}
+			if target != dest {
+				if err := os.Rename(target, dest); err != nil {
+					os.Remove(target)
+					return res, diskErrorf(err, "unable to move download into place: %v", err)
+				}
+			}
+			d.stats.completed.Add(1)
+			d.mirror.keepPath(dest)
+			res.bytes = written
+			if sums := t.sums(); sums != "" && t.showHashes {
+				log.Printf("%s: %s", dest, sums)
+			}
+			if d.trashAfter {
+				res.trashed, err = d.trash(ctx, file, dest, written)
+			}
+			return res, err
+		}
+		os.Remove(target)
+		retries := d.redownloads(err)
+		if attempt >= retries {
+			return res, err
+		}
+		log.Printf("%s: %v, downloading again (%d/%d)", fileID, err, attempt+1, retries)
+	}
+}
+
+// fetch writes the content of file to dest and returns the number of bytes
+// written. Nothing is left behind at dest on failure.
+func (d *downloader) fetch(ctx context.Context, file *drive.File, dest string, t *transfer) (int64, error) {
+	if d.quotaCopies != nil {
+		defer d.dropQuotaCopy(ctx, file.Id)
+	}
+	if d.keepPartial && !isNative(file) && !d.gunzip && !d.gzip {
+		return d.fetchPartial(ctx, file, dest, t)
+	}
+	if d.splitsIntoParts(file) {
+		written, err := d.fetchParts(ctx, file, dest, t)
+		if !errors.Is(err, errRangeIgnored) {
+			return written, err
+		}
+		log.Printf("%s: %v, downloading it in one piece", file.Id, err)
+	}
+	src, err := d.stream(ctx, file)
+	if err != nil {
+		return 0, err
+	}
+
+	if m := d.fileMode(file); (m != 0 && m&0200 == 0) || d.newFileMode&0200 == 0 {
+		// An earlier run may have left a read-only copy, which os.Create
+		// cannot truncate. It would be truncated anyway.
+		os.Remove(dest)
+	}
+	outFile, err := d.create(dest)
+	if err != nil {
+		src.Close()
+		return 0, diskErrorf(err, "unable to create download file: %v", err)
+	}
+	t.reset()
+	var written int64
+	if d.gunzip || d.gzip {
+		written, err = d.copyTransformed(ctx, file, outFile, src, t)
+	} else {
+		written, err = d.copyContent(ctx, file, outFile, src, t)
+	}
+	if err != nil {
+		outFile.Close()
+		os.Remove(dest)
+		if errors.Is(err, errNotGzip) {
+			return 0, err
+		}
+		return 0, diskErrorf(err, "unable to write file content: %v", err)
+	}
+	if err := outFile.Close(); err != nil {
+		os.Remove(dest)
+		return 0, diskErrorf(err, "unable to write file content: %v", err)
+	}
+	return written, nil
+}
+
+// checkSize compares the bytes written with the size Drive reports, which
+// catches truncated transfers even without checksums. Exports are skipped as
+// Drive reports no size for them.
+//
+// The v3 media endpoint always serves the stored bytes, so there is no
+// separate "original" variant to ask for. A mismatch means the transfer was
+// cut short or the content was transformed on the way (e.g. a processed
+// image or video). It is a warning unless strictSize is set.
+func (d *downloader) checkSize(file *drive.File, dest string, written int64) error {
+	if isNative(file) || written == file.Size {
+		return nil
+	}
+	if d.strictSize {
+		return fmt.Errorf("size mismatch, downloaded %d bytes but Drive reports %d", written, file.Size)
+	}
+	log.Printf("Warning: %s: downloaded %d bytes but Drive reports %d, the content may be truncated or transformed", dest, written, file.Size)
+	return nil
+}
+
+// open returns a file's content stream together with its metadata, leaving
+// it to the caller what to do with the bytes. The caller must close the
+// stream.
+func (d *downloader) open(ctx context.Context, fileID string) (io.ReadCloser, *drive.File, error) {
+	file, err := d.metadata(ctx, fileID)
+	if err != nil {
+		return nil, nil, err
+	}
+	src, err := d.stream(ctx, file)
+	if err != nil {
+		return nil, nil, err
+	}
+	return src, file, nil
+}
+
+// stream opens the content of a file whose metadata is known as a reader
+// that resumes broken transfers. It is what open returns, and what fetch
+// and the sink write out.
+func (d *downloader) stream(ctx context.Context, file *drive.File) (*resumingReader, error) {
+	resp, err := d.openContent(ctx, file, 0)
+	if err != nil {
+		return nil, err
+	}
+	return d.resumable(ctx, file, resp), nil
+}
+
+// openContent starts the media download of a file, from offset onwards when
+// offset is positive. Each call asks Drive for a fresh media link. Native
+// files are exported instead; exports do not honour ranges.
+func (d *downloader) openContent(ctx context.Context, file *drive.File, offset int64) (*http.Response, error) {
+	if isNative(file) {
+		return d.export(ctx, file)
+	}
+	return d.openRange(ctx, file, offset, -1)
+}
+
+// openRange requests the bytes from offset to end, included, of a stored
+// file, or to its end when end is negative. Ranges with an end are only
+// asked by --parallel-file-parts, which is not used with quota copies.
+func (d *downloader) openRange(ctx context.Context, file *drive.File, offset, end int64) (*http.Response, error) {
+	var resp *http.Response
+	get := func(acknowledgeAbuse bool) error {
+		return d.retry.do(ctx, file.Id, func() (err error) {
+			call := d.srv.Files.Get(file.Id).SupportsAllDrives(true).Context(ctx)
+			if acknowledgeAbuse {
+				call.AcknowledgeAbuse(true)
+			}
+			switch {
+			case end >= 0:
+				call.Header().Set("Range", fmt.Sprintf("bytes=%d-%d", offset, end))
+			case offset > 0:
+				call.Header().Set("Range", fmt.Sprintf("bytes=%d-", offset))
+			}
+			resp, err = call.Download()
+			return err
+		})
+	}
+	err := get(false)
+	if isAbusiveFile(err) {
+		if !d.acknowledgeAbuse {
+			return nil, errAbusiveFile
+		}
+		log.Printf("%s: Drive flagged the file as malware or spam, downloading it anyway as --acknowledge-abuse asks", file.Id)
+		err = get(true)
+	}
+	if isDownloadQuotaExceeded(err) {
+		if d.quotaCopies != nil && end < 0 {
+			return d.openCopy(ctx, file, offset)
+		}
+		return nil, errDownloadQuota
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to download file: %v", err)
+	}
+	return resp, nil
+}
+
+// copyContent writes src, which starts at byte src.read of the file, to
+// out and closes it. The stream resumes itself when it breaks part way; an
+// export that breaks is started over, as exports cannot be requested from
+// an offset. Write errors are never resumed. It returns the size of the
+// file written so far, the starting offset included.
+func (d *downloader) copyContent(ctx context.Context, file *drive.File, out *os.File, src *resumingReader, t *transfer) (int64, error) {
+	buf := d.buffers.Get().(*[]byte)
+	defer d.buffers.Put(buf)
+
+	defer src.Close()
+	if src.read > 0 {
+		t.skipHashes()
+	}
+	src.restart = func() error {
+		if _, err := out.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		if err := out.Truncate(0); err != nil {
+			return err
+		}
+		t.reset()
+		return nil
+	}
+	_, err := io.CopyBuffer(countingWriter{out, t}, src, *buf)
+	return src.read, err
+}
+
+// metadata fetches the fields of a file that the enabled options need.
+func (d *downloader) metadata(ctx context.Context, fileID string) (*drive.File, error) {
+	var file *drive.File
+	get := func() error {
+		return d.retry.do(ctx, fileID, func() (err error) {
+			file, err = d.srv.Files.Get(fileID).Fields(d.fileFields()).SupportsAllDrives(true).Context(ctx).Do()
+			return err
+		})
+	}
+	err := get()
+	if d.waitAvailable > 0 && isUnavailable(err) {
+		err = d.awaitAvailability(ctx, fileID, err, get)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to retrieve file: %w", err)
+	}
+	return file, nil
+}
+
+// resolveFile works out the local output path of a file whose metadata is
+// already known, without touching the filesystem. A non-empty output
+// replaces the folder reconstruction and naming altogether.
+func (d *downloader) resolveFile(ctx context.Context, file *drive.File, output string) (string, error) {
+	if output != "" {
+		if !filepath.IsLocal(output) {
+			return "", fmt.Errorf("output path %q must be relative and stay inside the output directory", output)
+		}
+		return d.collisions.claim(file.Id, d.normalize(filepath.Clean(output))), nil
+	}
+
+	var p string
+	var err error
+	if d.organizeShared && file.SharedWithMeTime != "" {
+		p = sharedFolder(file)
+	} else if !d.noPath {
+		if p, err = getFolderPath(ctx, d.parents, file); err != nil {
+			return "", &pathError{err}
+		}
+	}
+
+	dest, err := d.namer.Name(file, p)
+	if err != nil {
+		return "", fmt.Errorf("unable to name output file: %v", err)
+	}
+	ext := d.exportExtension(file)
+	dest += ext
+	switch {
+	case ext != "" && d.exportsDir != "":
+		dest = filepath.Join(d.exportsDir, dest)
+	case len(d.mimeRoutes) > 0:
+		if dir := routeDir(d.mimeRoutes, file.MimeType); dir != "" {
+			dest = filepath.Join(dir, dest)
+		}
+	}
+	dest = d.compressedName(dest)
+	return d.collisions.claim(file.Id, d.normalize(dest)), nil
+}
+
+// resolveInto works out the output path of a file written into dir under
+// its own name, as the files linked from a Doc are.
+func (d *downloader) resolveInto(file *drive.File, dir string) string {
+	dest := d.compressedName(filepath.Join(dir, file.Name) + d.exportExtension(file))
+	return d.collisions.claim(file.Id, d.normalize(dest))
+}
+
+// exportExtension returns the extension a native file is exported with, or
+// none for other files.
+func (d *downloader) exportExtension(file *drive.File) string {
+	if format, ok := d.exportFormat(file); ok && isNative(file) {
+		return format.extension
+	}
+	return ""
+}
+
+// pathError is a failure to look up a file's folder path. The lookups are
+// many small calls, so they are the ones a rate limit hits first, and are
+// worth another go once the rest of the batch is done.
+type pathError struct {
+	err error
+}
+
+func (e *pathError) Error() string {
+	return fmt.Sprintf("unable to retrieve folder path: %v", e.err)
+}
+
+func (e *pathError) Unwrap() error {
+	return e.err
+}
+
+// sharedFolder returns shared/<owner email> for a file that was shared with
+// the user, whose parents usually cannot be traversed.
+func sharedFolder(file *drive.File) string {
+	owner := "unknown"
+	if len(file.Owners) > 0 && file.Owners[0].EmailAddress != "" {
+		owner = file.Owners[0].EmailAddress
+	}
+	return filepath.Join("shared", owner)
+}
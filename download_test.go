@@ -0,0 +1,377 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// saveByID downloads a file the way the pipeline does, from its ID to the
+// path resolved for it, and returns that path.
+func saveByID(t *testing.T, d *downloader, id string) (string, error) {
+	t.Helper()
+	ctx := context.Background()
+	file, err := d.metadata(ctx, id)
+	if err != nil {
+		return "", err
+	}
+	dest, err := d.resolveFile(ctx, file, "")
+	if err != nil {
+		return "", err
+	}
+	_, err = d.save(ctx, file, dest)
+	return dest, err
+}
+
+// checkContent fails the test unless path holds want.
+func checkContent(t *testing.T, path string, want []byte) {
+	t.Helper()
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s holds %d bytes, want %d", path, len(got), len(want))
+	}
+}
+
+func TestDownloadNestedFolders(t *testing.T) {
+	t.Chdir(t.TempDir())
+	fd := newFakeDrive(t)
+	seedFixtures(fd)
+
+	dest, err := saveByID(t, fd.downloader(t), "small")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join("A", "B", "small.txt"); dest != want {
+		t.Errorf("downloaded to %s, want %s", dest, want)
+	}
+	checkContent(t, dest, []byte("hello, drive\n"))
+	if n := fd.callsTo(routeToken, ""); n != 1 {
+		t.Errorf("%d token exchanges, want 1", n)
+	}
+}
+
+func TestDownloadSharedDrivePath(t *testing.T) {
+	t.Chdir(t.TempDir())
+	fd := newFakeDrive(t)
+	seedFixtures(fd)
+
+	dest, err := saveByID(t, fd.downloader(t), "report")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join("Team", "Reports", "report.csv"); dest != want {
+		t.Errorf("downloaded to %s, want %s", dest, want)
+	}
+}
+
+func TestExportNativeFile(t *testing.T) {
+	t.Chdir(t.TempDir())
+	fd := newFakeDrive(t)
+	seedFixtures(fd)
+
+	d := fd.downloader(t)
+	d.exportAs = map[string]exportFormat{googleDocMimeType: {"application/pdf", ".pdf"}}
+	dest, err := saveByID(t, d, "doc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join("A", "Notes.pdf"); dest != want {
+		t.Errorf("exported to %s, want %s", dest, want)
+	}
+	checkContent(t, dest, []byte("%PDF-1.4 pdf bytes"))
+}
+
+func TestDownloadResumesBrokenTransfer(t *testing.T) {
+	t.Chdir(t.TempDir())
+	fd := newFakeDrive(t)
+	seedFixtures(fd)
+	fd.cut("large", 1<<20)
+
+	d := fd.downloader(t)
+	d.verifyMD5 = true
+	dest, err := saveByID(t, d, "large")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkContent(t, dest, largeFixture)
+	if n := fd.callsTo(routeMedia, "large"); n != 2 {
+		t.Errorf("%d media requests, want 2", n)
+	}
+}
+
+func TestDownloadRetriesRateLimit(t *testing.T) {
+	t.Chdir(t.TempDir())
+	fd := newFakeDrive(t)
+	seedFixtures(fd)
+	fd.fail(routeMedia, "small", fakeFailure{http.StatusTooManyRequests, "rateLimitExceeded"})
+
+	dest, err := saveByID(t, fd.downloader(t), "small")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkContent(t, dest, []byte("hello, drive\n"))
+	if n := fd.callsTo(routeMedia, "small"); n != 2 {
+		t.Errorf("%d media requests, want 2", n)
+	}
+}
+
+func TestDownloadQuotaExceededIsNotRetried(t *testing.T) {
+	t.Chdir(t.TempDir())
+	fd := newFakeDrive(t)
+	seedFixtures(fd)
+	fd.fail(routeMedia, "small", fakeFailure{http.StatusForbidden, "downloadQuotaExceeded"})
+
+	dest, err := saveByID(t, fd.downloader(t), "small")
+	if err != errDownloadQuota {
+		t.Fatalf("got %v, want errDownloadQuota", err)
+	}
+	if _, err := os.Stat(dest); !os.IsNotExist(err) {
+		t.Errorf("%s was left behind", dest)
+	}
+	if n := fd.callsTo(routeMedia, "small"); n != 1 {
+		t.Errorf("%d media requests, want 1", n)
+	}
+}
+
+func TestExpiredRefreshToken(t *testing.T) {
+	t.Chdir(t.TempDir())
+	fd := newFakeDrive(t)
+	seedFixtures(fd)
+	fd.refreshFails = true
+
+	_, err := saveByID(t, fd.downloader(t), "small")
+	if !isTokenExpired(err) {
+		t.Fatalf("got %v, want an expired token", err)
+	}
+}
+
+func TestOpenStreamsContent(t *testing.T) {
+	fd := newFakeDrive(t)
+	seedFixtures(fd)
+	fd.cut("large", 100<<10)
+
+	body, file, err := fd.downloader(t).open(context.Background(), "large")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer body.Close()
+	got, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if file.Name != "large.bin" || !bytes.Equal(got, largeFixture) {
+		t.Errorf("open returned %s with %d bytes, want large.bin with %d", file.Name, len(got), len(largeFixture))
+	}
+}
+
+func TestProgressIncreases(t *testing.T) {
+	t.Chdir(t.TempDir())
+	fd := newFakeDrive(t)
+	seedFixtures(fd)
+	fd.cut("large", 1<<20)
+
+	d := fd.downloader(t)
+	var reported []int64
+	d.progress = func(fileID string, bytesSoFar, totalBytes int64) {
+		if fileID != "large" || totalBytes != int64(len(largeFixture)) {
+			t.Errorf("progress of %s with size %d, want large with %d", fileID, totalBytes, len(largeFixture))
+		}
+		reported = append(reported, bytesSoFar)
+	}
+	if _, err := saveByID(t, d, "large"); err != nil {
+		t.Fatal(err)
+	}
+	if len(reported) < 2 {
+		t.Fatalf("progress reported %d times, want several", len(reported))
+	}
+	for i := 1; i < len(reported); i++ {
+		if reported[i] <= reported[i-1] {
+			t.Fatalf("progress went from %d to %d", reported[i-1], reported[i])
+		}
+	}
+	if last := reported[len(reported)-1]; last != int64(len(largeFixture)) {
+		t.Errorf("last progress %d, want %d", last, len(largeFixture))
+	}
+}
+
+func TestPlanComparesChecksums(t *testing.T) {
+	t.Chdir(t.TempDir())
+	fd := newFakeDrive(t)
+	seedFixtures(fd)
+
+	d := fd.downloader(t)
+	d.dryRun = true
+	file, err := d.metadata(context.Background(), "small")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dest := filepath.Join("A", "B", "small.txt")
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct{ content, want string }{
+		{"hello, drive\n", planKeep},
+		{"HELLO, DRIVE\n", planUpdate},
+	} {
+		if err := os.WriteFile(dest, []byte(c.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := d.planAction(file, dest); err != nil || got != c.want {
+			t.Errorf("plan for %q is %q (%v), want %q", c.content, got, err, c.want)
+		}
+	}
+}
+
+func TestKeepPartialCompletesFullPartial(t *testing.T) {
+	t.Chdir(t.TempDir())
+	fd := newFakeDrive(t)
+	seedFixtures(fd)
+
+	d := fd.downloader(t)
+	d.keepPartial = true
+	file, err := d.metadata(context.Background(), "small")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dest := filepath.Join("A", "B", "small.txt")
+	meta, err := json.Marshal(partialMetaOf(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(dest+partialExt, []byte("hello, drive\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(dest+partialMetaExt, meta, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := saveByID(t, d, "small"); err != nil {
+		t.Fatal(err)
+	}
+	checkContent(t, dest, []byte("hello, drive\n"))
+	if n := fd.callsTo(routeMedia, "small"); n != 0 {
+		t.Errorf("%d media requests, want none", n)
+	}
+	for _, path := range []string{dest + partialExt, dest + partialMetaExt} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s was left behind", path)
+		}
+	}
+}
+
+func TestExportCommentsRetriesAndWarns(t *testing.T) {
+	t.Chdir(t.TempDir())
+	fd := newFakeDrive(t)
+	seedFixtures(fd)
+	fd.addComment("small", "Looks good")
+	fd.fail(routeCmts, "small", fakeFailure{http.StatusServiceUnavailable, "backendError"})
+
+	d := fd.downloader(t)
+	d.exportComments = true
+	dest, err := saveByID(t, d, "small")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(dest + commentsSidecarExt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(b, []byte("Looks good")) {
+		t.Errorf("comments sidecar holds %s", b)
+	}
+
+	// Comments that cannot be listed do not fail the download.
+	os.RemoveAll("A")
+	fd.fail(routeCmts, "small", fakeFailure{http.StatusForbidden, "insufficientFilePermissions"})
+	if dest, err = saveByID(t, d, "small"); err != nil {
+		t.Fatal(err)
+	}
+	checkContent(t, dest, []byte("hello, drive\n"))
+}
+
+func TestLocalSinkModes(t *testing.T) {
+	t.Chdir(t.TempDir())
+	fd := newFakeDrive(t)
+	seedFixtures(fd)
+
+	// Modes the usual umasks leave alone.
+	d := fd.downloader(t)
+	d.newFileMode, d.dirMode = 0640, 0750
+	var err error
+	if d.sink, err = openSink(context.Background(), "file://out", d.newFileMode, d.dirMode); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := saveByID(t, d, "small"); err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string]os.FileMode{
+		filepath.Join("out", "A", "B"):              0750,
+		filepath.Join("out", "A", "B", "small.txt"): 0640,
+	} {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := info.Mode().Perm(); got != want {
+			t.Errorf("%s has mode %v, want %v", path, got, want)
+		}
+	}
+}
+
+func TestSidecarsUseFileMode(t *testing.T) {
+	t.Chdir(t.TempDir())
+	fd := newFakeDrive(t)
+	seedFixtures(fd)
+	fd.addComment("small", "Looks good")
+	// The transfer breaks off for good, so the partial's sidecar stays.
+	fd.cut("small", 5, 0, 0)
+
+	d := fd.downloader(t)
+	d.newFileMode = 0640
+	d.extraFields = []string{"description"}
+	d.exportComments = true
+	d.keepPartial = true
+	dest, err := saveByID(t, d, "small")
+	if err == nil {
+		t.Fatal("the broken download succeeded")
+	}
+	for _, path := range []string{dest + metadataSidecarExt, dest + commentsSidecarExt, dest + partialMetaExt} {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := info.Mode().Perm(); got != d.newFileMode {
+			t.Errorf("%s has mode %v, want %v", path, got, d.newFileMode)
+		}
+	}
+}
+
+func TestGunzipPlainContentFailsOnce(t *testing.T) {
+	t.Chdir(t.TempDir())
+	fd := newFakeDrive(t)
+	seedFixtures(fd)
+
+	d := fd.downloader(t)
+	d.gunzip = true
+	if _, err := saveByID(t, d, "small"); !errors.Is(err, errNotGzip) {
+		t.Fatalf("got %v, want errNotGzip", err)
+	}
+	if n := fd.callsTo(routeMedia, "small"); n != 1 {
+		t.Errorf("%d media requests, want 1", n)
+	}
+	if d.redownloads(fmt.Errorf("x: %w", errNotGzip)) != 0 {
+		t.Error("content that is not gzip is downloaded again")
+	}
+}
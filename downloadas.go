@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"strings"
+
+	"google.golang.org/api/drive/v3"
+)
+
+// parseDownloadAs checks the MIME type of --download-as or an
+// --input-json "download_as".
+func parseDownloadAs(mimeType string) (string, error) {
+	if kind, sub, ok := strings.Cut(mimeType, "/"); !ok || kind == "" || sub == "" {
+		return "", fmt.Errorf("invalid download type %q, expected a MIME type such as application/pdf", mimeType)
+	}
+	// A stored file named and handled as a Google Doc, a folder or a
+	// shortcut would be exported, listed or followed instead of downloaded.
+	if strings.HasPrefix(mimeType, nativeMimePrefix) {
+		return "", fmt.Errorf("invalid download type %q, stored files cannot be downloaded as a Google Workspace type (--export-format picks how Google Docs are exported)", mimeType)
+	}
+	return mimeType, nil
+}
+
+// forceType returns file as --download-as or its --input-json entry says
+// to treat it: of the given MIME type, and named with that type's extension
+// unless the name already ends in it. Only the name and the handling that
+// goes by type change; the content is downloaded as it is, nothing is
+// converted. The flag covers the files given as input, not the contents of
+// their folders, and never applies to Google Docs, folders or shortcuts,
+// which have no content of their own to download.
+func (d *downloader) forceType(file *drive.File, given bool) *drive.File {
+	mimeType, ok := d.downloadAsByID[file.Id]
+	if !ok && given {
+		mimeType = d.downloadAs
+	}
+	if mimeType == "" || mimeType == file.MimeType {
+		return file
+	}
+	if isNative(file) || file.MimeType == folderMimeType {
+		log.Printf("Warning: %s: not downloading it as %s, that only applies to stored files", file.Id, mimeType)
+		return file
+	}
+	forced := *file
+	forced.MimeType = mimeType
+	if ext := extensionFor(mimeType); ext != "" && !strings.EqualFold(path.Ext(file.Name), ext) {
+		forced.Name = file.Name + ext
+		forced.FileExtension = strings.TrimPrefix(ext, ".")
+	}
+	return &forced
+}
@@ -0,0 +1,21 @@
+package main
+
+import "testing"
+
+func TestParseDownloadAs(t *testing.T) {
+	for _, c := range []struct {
+		mimeType string
+		ok       bool
+	}{
+		{"application/pdf", true},
+		{"text/csv", true},
+		{"pdf", false},
+		{googleDocMimeType, false},
+		{folderMimeType, false},
+		{"application/vnd.google-apps.shortcut", false},
+	} {
+		if _, err := parseDownloadAs(c.mimeType); (err == nil) != c.ok {
+			t.Errorf("parseDownloadAs(%q) returned %v", c.mimeType, err)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	"golang.org/x/sync/semaphore"
+)
+
+// driveSlots limits the downloads in flight from each shared drive, for
+// --concurrency-per-drive, on top of the global limit. Files in My Drive
+// share the slots of the empty drive ID.
+type driveSlots struct {
+	limit int64
+
+	mu   sync.Mutex
+	sems map[string]*semaphore.Weighted
+}
+
+func newDriveSlots(limit int) *driveSlots {
+	return &driveSlots{limit: int64(limit), sems: map[string]*semaphore.Weighted{}}
+}
+
+// acquire waits for a slot of the given drive, returning its release.
+func (s *driveSlots) acquire(ctx context.Context, driveID string) (func(), error) {
+	s.mu.Lock()
+	sem, ok := s.sems[driveID]
+	if !ok {
+		sem = semaphore.NewWeighted(s.limit)
+		s.sems[driveID] = sem
+	}
+	s.mu.Unlock()
+	if err := sem.Acquire(ctx, 1); err != nil {
+		return nil, err
+	}
+	return func() { sem.Release(1) }, nil
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"google.golang.org/api/drive/v3"
+)
+
+// listDrives writes the ID and name of every shared drive the user can
+// access, for --list-drives. A shared drive's ID is also the ID of its root
+// folder, so the IDs can be fed back as input with --recursive.
+func listDrives(ctx context.Context, srv *drive.Service, out *lineWriter) error {
+	err := srv.Drives.List().PageSize(100).Fields("nextPageToken,drives(id,name)").Pages(ctx, func(list *drive.DriveList) error {
+		for _, d := range list.Drives {
+			out.printf("%s\t%s", d.Id, d.Name)
+			out.object(struct {
+				ID   string `json:"id"`
+				Name string `json:"name"`
+			}{d.Id, d.Name})
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("unable to list shared drives: %v", err)
+	}
+	return nil
+}
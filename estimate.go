@@ -0,0 +1,44 @@
+package main
+
+import (
+	"log"
+
+	"google.golang.org/api/drive/v3"
+)
+
+// contentCalls estimates the API requests a real run would make to save
+// file after the dry run planned action for it: the download or export
+// itself and the requests of the options that fetch more per file. A sheet
+// exported per tab is counted as its spreadsheet lookup and a single tab,
+// and retries are never counted, so the estimate is a lower bound.
+func (p *pipeline) contentCalls(file *drive.File, action string) int64 {
+	d := p.d
+	if (action == planKeep && d.skipExisting) || d.unchangedSince(file) || (isEmptyFile(file) && d.onEmptyFile == onEmptySkip) {
+		return 0
+	}
+	n := int64(1)
+	if d.splitsIntoParts(file) {
+		n = int64(d.parts)
+	}
+	if d.sheets != nil && file.MimeType == spreadsheetMimeType {
+		n++
+	}
+	if d.exportComments {
+		n++
+	}
+	if p.revisions > 0 && !isNative(file) {
+		// The revision list, then each revision kept.
+		n += 1 + int64(p.revisions)
+	}
+	return n
+}
+
+// logCallEstimate logs how many API requests the run planned by --dry-run
+// would make: the ones the dry run made itself to list the input, fetch
+// metadata and look up folder paths through the same caches, which a real
+// run repeats, and the planned downloads and exports.
+func (p *pipeline) logCallEstimate() {
+	lookups, content := p.d.stats.apiCalls.Load(), p.plannedCalls.Load()
+	log.Printf("Estimated API calls for this run: at least %d (%d to list and look up files, %d to download and export)",
+		lookups+content, lookups, content)
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
+)
+
+// nativeMimePrefix marks Google Docs, Sheets, Slides and the other native
+// types, which have no bytes of their own and must be exported.
+const nativeMimePrefix = "application/vnd.google-apps."
+
+// exportFormat is the format a native file is converted to on export.
+type exportFormat struct {
+	mimeType  string
+	extension string
+}
+
+// exportFormats maps native types to the format they are exported as.
+var exportFormats = map[string]exportFormat{
+	"application/vnd.google-apps.document":     {"application/vnd.openxmlformats-officedocument.wordprocessingml.document", ".docx"},
+	"application/vnd.google-apps.spreadsheet":  {"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", ".xlsx"},
+	"application/vnd.google-apps.presentation": {"application/vnd.openxmlformats-officedocument.presentationml.presentation", ".pptx"},
+	"application/vnd.google-apps.drawing":      {"application/pdf", ".pdf"},
+	"application/vnd.google-apps.script":       {"application/vnd.google-apps.script+json", ".json"},
+}
+
+// exportExtensions names the export formats mime.ExtensionsByType does not
+// know, or knows several extensions for.
+var exportExtensions = map[string]string{
+	"application/pdf": ".pdf",
+	"application/vnd.openxmlformats-officedocument.wordprocessingml.document":   ".docx",
+	"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet":         ".xlsx",
+	"application/vnd.openxmlformats-officedocument.presentationml.presentation": ".pptx",
+	"application/vnd.oasis.opendocument.text":                                   ".odt",
+	"application/vnd.oasis.opendocument.spreadsheet":                            ".ods",
+	"application/vnd.oasis.opendocument.presentation":                           ".odp",
+	"application/vnd.google-apps.script+json":                                   ".json",
+	"application/rtf":           ".rtf",
+	"application/epub+zip":      ".epub",
+	"application/zip":           ".zip",
+	"text/plain":                ".txt",
+	"text/html":                 ".html",
+	"text/csv":                  ".csv",
+	"text/tab-separated-values": ".tsv",
+	"text/markdown":             ".md",
+	"image/jpeg":                ".jpg",
+	"image/png":                 ".png",
+	"image/svg+xml":             ".svg",
+}
+
+// isNative reports whether file is a native Google type that has to be
+// exported rather than downloaded.
+func isNative(file *drive.File) bool {
+	return strings.HasPrefix(file.MimeType, nativeMimePrefix)
+}
+
+// parseExportFormats parses --export-format values of the form
+// <type>=<format>, where type is a native type with or without the
+// application/vnd.google-apps. prefix and format a MIME type or an
+// extension, e.g. document=application/pdf or document=md. A colon may
+// stand for the equals sign: document:md.
+func parseExportFormats(values []string) (map[string]exportFormat, error) {
+	formats := make(map[string]exportFormat)
+	for _, v := range values {
+		native, name, ok := strings.Cut(v, "=")
+		if !ok {
+			native, name, ok = strings.Cut(v, ":")
+		}
+		if !ok || native == "" || name == "" {
+			return nil, fmt.Errorf("invalid --export-format %q, expected <type>=<mime type or extension>", v)
+		}
+		if !strings.HasPrefix(native, nativeMimePrefix) {
+			native = nativeMimePrefix + native
+		}
+		format, err := parseExportName(name)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --export-format %q: %v", v, err)
+		}
+		formats[native] = format
+	}
+	return formats, nil
+}
+
+// extensionFor returns the file extension of an export MIME type, or none if
+// it is unknown.
+func extensionFor(mimeType string) string {
+	if ext, ok := exportExtensions[mimeType]; ok {
+		return ext
+	}
+	if exts, err := mime.ExtensionsByType(mimeType); err == nil && len(exts) > 0 {
+		return exts[0]
+	}
+	return ""
+}
+
+// exportFormat returns the format a native file is exported as: the one
+// its --input-json entry asks for, the one requested with --export-format, the default for its type, or, for types
+// without a default, one of the export links Drive lists for the file,
+// preferring PDF.
+func (d *downloader) exportFormat(file *drive.File) (exportFormat, bool) {
+	if format, ok := d.exportByID[file.Id]; ok {
+		return format, true
+	}
+	if format, ok := d.exportAs[file.MimeType]; ok {
+		return format, true
+	}
+	if format, ok := exportFormats[file.MimeType]; ok {
+		return format, true
+	}
+	if len(file.ExportLinks) == 0 {
+		return exportFormat{}, false
+	}
+	if _, ok := file.ExportLinks["application/pdf"]; ok {
+		return exportFormat{"application/pdf", ".pdf"}, true
+	}
+	first := exportTypes(file)[0]
+	return exportFormat{first, extensionFor(first)}, true
+}
+
+// parseExportOptions parses --export-option values of the form
+// <type>:<key>=<value>, with type as in --export-format, e.g.
+// spreadsheet:gridlines=false.
+func parseExportOptions(values []string) (map[string]url.Values, error) {
+	options := make(map[string]url.Values)
+	for _, v := range values {
+		native, option, ok := strings.Cut(v, ":")
+		key, value, hasValue := strings.Cut(option, "=")
+		if !ok || !hasValue || native == "" || key == "" {
+			return nil, fmt.Errorf("invalid --export-option %q, expected <type>:<key>=<value>", v)
+		}
+		if !strings.HasPrefix(native, nativeMimePrefix) {
+			native = nativeMimePrefix + native
+		}
+		if options[native] == nil {
+			options[native] = url.Values{}
+		}
+		options[native].Add(key, value)
+	}
+	return options, nil
+}
+
+// export starts the export of a native file. Files.Export only converts to a
+// fixed list of formats (and only up to a size limit), so when it refuses,
+// the file's own export link for the format is fetched instead, if Drive
+// lists one.
+//
+// Files.Export takes no conversion options at all. Options given with
+// --export-option are passed through as query parameters of the export
+// link, so files of a type with options are always exported through their
+// link. Which parameters are honoured is up to the Docs editors behind the
+// link and is not documented by the Drive API; unknown ones are ignored
+// rather than rejected.
+func (d *downloader) export(ctx context.Context, file *drive.File) (*http.Response, error) {
+	format, ok := d.exportFormat(file)
+	if !ok {
+		return nil, fmt.Errorf("unable to download file: %s cannot be exported", file.MimeType)
+	}
+	link, hasLink := file.ExportLinks[format.mimeType]
+	if options := d.exportOptions[file.MimeType]; len(options) > 0 {
+		if !hasLink {
+			return nil, fmt.Errorf("unable to export file: --export-option needs an export link for %s, which Drive does not list for this file", format.mimeType)
+		}
+		u, err := url.Parse(link)
+		if err != nil {
+			return nil, fmt.Errorf("unable to export file: invalid export link: %v", err)
+		}
+		q := u.Query()
+		for key, values := range options {
+			q[key] = values
+		}
+		u.RawQuery = q.Encode()
+		return d.fetchExportLink(ctx, file, u.String())
+	}
+
+	var resp *http.Response
+	err := d.retry.do(ctx, file.Id, func() (err error) {
+		resp, err = d.srv.Files.Export(file.Id, format.mimeType).Context(ctx).Download()
+		return err
+	})
+	if err == nil {
+		return resp, nil
+	}
+	if !hasLink || !exportRefused(err) {
+		if file.ExportLinks != nil && !hasLink {
+			return nil, fmt.Errorf("unable to export file: %s is not available for this file, it can be exported as %s", format.mimeType, strings.Join(exportTypes(file), ", "))
+		}
+		return nil, fmt.Errorf("unable to export file: %v", err)
+	}
+	return d.fetchExportLink(ctx, file, link)
+}
+
+// fetchExportLink downloads an export link with the authorized client.
+func (d *downloader) fetchExportLink(ctx context.Context, file *drive.File, link string) (*http.Response, error) {
+	var resp *http.Response
+	err := d.retry.do(ctx, file.Id, func() error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, link, nil)
+		if err != nil {
+			return err
+		}
+		if resp, err = d.client.Do(req); err != nil {
+			return err
+		}
+		if err = googleapi.CheckResponse(resp); err != nil {
+			resp.Body.Close()
+		}
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to export file through its export link: %v", err)
+	}
+	return resp, nil
+}
+
+// exportRefused reports whether Files.Export turned down the conversion
+// itself, as opposed to failing for a reason an export link would share.
+func exportRefused(err error) bool {
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	return apiErr.Code == http.StatusBadRequest || hasReason(apiErr, "exportSizeLimitExceeded")
+}
+
+// exportTypes lists the formats Drive offers export links for.
+func exportTypes(file *drive.File) []string {
+	types := make([]string, 0, len(file.ExportLinks))
+	for t := range file.ExportLinks {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	return types
+}
@@ -0,0 +1,606 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/option"
+)
+
+// fakeDrive is a stub Drive API server for tests. It serves files get,
+// media downloads with byte ranges, exports, revisions, comments, files
+// list, shared drive lookups and the OAuth token exchange from fixtures held
+// in memory, and can be told to fail requests the way Drive does.
+type fakeDrive struct {
+	*httptest.Server
+
+	mu    sync.Mutex
+	files map[string]*fakeFile
+	// drives are the names of the shared drives, by ID.
+	drives map[string]string
+	// failures are the errors the next requests of a route and ID answer
+	// with, in order, before requests succeed again.
+	failures map[string][]fakeFailure
+	// cuts are the byte counts after which the next media response of a
+	// file breaks off.
+	cuts  map[string][]int
+	calls map[string]int
+	// refreshFails makes the token exchange turn every refresh down.
+	refreshFails bool
+	// latency delays every API response, so concurrent requests overlap.
+	latency time.Duration
+}
+
+// fakeFile is a file of the fake Drive: its metadata, its stored content
+// and, for native files, its exports by MIME type. revisions are its
+// history, oldest first, the last one being the current content.
+type fakeFile struct {
+	meta      *drive.File
+	content   []byte
+	exports   map[string][]byte
+	revisions []fakeRevision
+	comments  []*drive.Comment
+}
+
+// fakeRevision is a revision of a stored file.
+type fakeRevision struct {
+	meta    *drive.Revision
+	content []byte
+}
+
+// fakeFailure is an error response: an HTTP status and the reason Drive
+// gives for it, such as rateLimitExceeded.
+type fakeFailure struct {
+	code   int
+	reason string
+}
+
+// Routes of the fake Drive, for fail and calls.
+const (
+	routeGet    = "get"
+	routeMedia  = "media"
+	routeExport = "export"
+	routeList   = "list"
+	routeDrive  = "drive"
+	routeRevs   = "revisions"
+	routeCmts   = "comments"
+	routeToken  = "token"
+)
+
+// fakeDocxMimeType is what Docs export as by default.
+const fakeDocxMimeType = "application/vnd.openxmlformats-officedocument.wordprocessingml.document"
+
+// fakeAccessToken is the access token the fake token exchange hands out,
+// and the only one the fake API accepts.
+const fakeAccessToken = "fake-access-token"
+
+func newFakeDrive(t *testing.T) *fakeDrive {
+	fd := &fakeDrive{
+		files:    map[string]*fakeFile{},
+		drives:   map[string]string{},
+		failures: map[string][]fakeFailure{},
+		cuts:     map[string][]int{},
+		calls:    map[string]int{},
+	}
+	fd.Server = httptest.NewServer(http.HandlerFunc(fd.serve))
+	t.Cleanup(fd.Close)
+	return fd
+}
+
+// addFolder adds a folder under parent, or at the root when parent is empty.
+func (fd *fakeDrive) addFolder(id, name, parent string) *drive.File {
+	return fd.add(&fakeFile{meta: &drive.File{Id: id, Name: name, MimeType: folderMimeType}}, parent)
+}
+
+// addFile adds a stored file with content under parent.
+func (fd *fakeDrive) addFile(id, name, parent string, content []byte) *drive.File {
+	sum := md5.Sum(content)
+	return fd.add(&fakeFile{
+		meta:    &drive.File{Id: id, Name: name, MimeType: "application/octet-stream", Size: int64(len(content)), Md5Checksum: hex.EncodeToString(sum[:])},
+		content: content,
+	}, parent)
+}
+
+// addNative adds a Google Workspace file of mimeType, exportable as the
+// given types.
+func (fd *fakeDrive) addNative(id, name, parent, mimeType string, exports map[string][]byte) *drive.File {
+	return fd.add(&fakeFile{meta: &drive.File{Id: id, Name: name, MimeType: mimeType}, exports: exports}, parent)
+}
+
+func (fd *fakeDrive) add(f *fakeFile, parent string) *drive.File {
+	if parent != "" {
+		f.meta.Parents = []string{parent}
+	}
+	f.meta.ModifiedTime = "2024-01-02T03:04:05.000Z"
+	f.meta.CreatedTime = "2024-01-01T00:00:00.000Z"
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+	if parent != "" {
+		if p, ok := fd.files[parent]; ok && p.meta.DriveId != "" {
+			f.meta.DriveId = p.meta.DriveId
+		} else if _, ok := fd.drives[parent]; ok {
+			f.meta.DriveId = parent
+		}
+	}
+	fd.files[f.meta.Id] = f
+	return f.meta
+}
+
+// addDrive adds a shared drive, whose root folder has the drive's ID.
+func (fd *fakeDrive) addDrive(id, name string) {
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+	fd.drives[id] = name
+}
+
+// fail makes the next requests of route for id answer with failures, one
+// each. The ID of list requests is the folder listed.
+func (fd *fakeDrive) fail(route, id string, failures ...fakeFailure) {
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+	fd.failures[route+" "+id] = append(fd.failures[route+" "+id], failures...)
+}
+
+// addRevision adds a revision made at modifiedTime to the history of id.
+func (fd *fakeDrive) addRevision(id, revID, modifiedTime string, content []byte) {
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+	f := fd.files[id]
+	f.revisions = append(f.revisions, fakeRevision{&drive.Revision{Id: revID, ModifiedTime: modifiedTime}, content})
+}
+
+// addComment adds a comment to id.
+func (fd *fakeDrive) addComment(id, content string) {
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+	f := fd.files[id]
+	f.comments = append(f.comments, &drive.Comment{Id: fmt.Sprint(len(f.comments) + 1), Content: content})
+}
+
+// pruneRevision drops the oldest revision of id, as Drive does over time.
+func (fd *fakeDrive) pruneRevision(id string) {
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+	f := fd.files[id]
+	f.revisions = f.revisions[1:]
+}
+
+// cut makes the next media responses of id break off after n bytes each.
+func (fd *fakeDrive) cut(id string, n ...int) {
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+	fd.cuts[id] = append(fd.cuts[id], n...)
+}
+
+// callsTo returns how many requests of route for id were made.
+func (fd *fakeDrive) callsTo(route, id string) int {
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+	return fd.calls[route+" "+id]
+}
+
+var (
+	fakeFilePath   = regexp.MustCompile(`^/files/([^/]+)$`)
+	fakeExportPath = regexp.MustCompile(`^/files/([^/]+)/export$`)
+	fakeDrivePath  = regexp.MustCompile(`^/drives/([^/]+)$`)
+	fakeRevsPath   = regexp.MustCompile(`^/files/([^/]+)/revisions(?:/([^/]+))?$`)
+	fakeCmtsPath   = regexp.MustCompile(`^/files/([^/]+)/comments$`)
+	fakeParentsQ   = regexp.MustCompile(`'([^']+)' in parents`)
+)
+
+func (fd *fakeDrive) serve(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/token" {
+		fd.serveToken(w, r)
+		return
+	}
+	time.Sleep(fd.latency)
+	if r.Header.Get("Authorization") != "Bearer "+fakeAccessToken {
+		fakeError(w, fakeFailure{http.StatusUnauthorized, "authError"})
+		return
+	}
+	switch m := fakeFilePath.FindStringSubmatch(r.URL.Path); {
+	case r.URL.Path == "/files":
+		fd.serveList(w, r)
+	case m != nil && r.URL.Query().Get("alt") == "media":
+		fd.serveMedia(w, r, m[1])
+	case m != nil:
+		fd.serveGet(w, r, m[1])
+	case fakeExportPath.MatchString(r.URL.Path):
+		fd.serveExport(w, r, fakeExportPath.FindStringSubmatch(r.URL.Path)[1])
+	case fakeRevsPath.MatchString(r.URL.Path):
+		m := fakeRevsPath.FindStringSubmatch(r.URL.Path)
+		fd.serveRevisions(w, r, m[1], m[2])
+	case fakeCmtsPath.MatchString(r.URL.Path):
+		fd.serveComments(w, r, fakeCmtsPath.FindStringSubmatch(r.URL.Path)[1])
+	case fakeDrivePath.MatchString(r.URL.Path):
+		fd.serveDrive(w, fakeDrivePath.FindStringSubmatch(r.URL.Path)[1])
+	default:
+		fakeError(w, fakeFailure{http.StatusNotFound, "notFound"})
+	}
+}
+
+// begin counts a request and returns the file it is for and the failure it
+// has to answer with, if any.
+func (fd *fakeDrive) begin(route, id string) (*fakeFile, *fakeFailure) {
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+	key := route + " " + id
+	fd.calls[key]++
+	if pending := fd.failures[key]; len(pending) > 0 {
+		fd.failures[key] = pending[1:]
+		return nil, &pending[0]
+	}
+	return fd.files[id], nil
+}
+
+func (fd *fakeDrive) serveGet(w http.ResponseWriter, r *http.Request, id string) {
+	f, failure := fd.begin(routeGet, id)
+	if failure != nil {
+		fakeError(w, *failure)
+		return
+	}
+	if f == nil {
+		fakeError(w, fakeFailure{http.StatusNotFound, "notFound"})
+		return
+	}
+	writeFields(w, r, f.meta)
+}
+
+// serveMedia serves a file's content, honouring a Range header the way the
+// media endpoint does.
+func (fd *fakeDrive) serveMedia(w http.ResponseWriter, r *http.Request, id string) {
+	f, failure := fd.begin(routeMedia, id)
+	if failure != nil {
+		fakeError(w, *failure)
+		return
+	}
+	if f == nil || f.content == nil {
+		fakeError(w, fakeFailure{http.StatusNotFound, "notFound"})
+		return
+	}
+	body, status := f.content, http.StatusOK
+	if rng := r.Header.Get("Range"); rng != "" {
+		start, end, ok := parseFakeRange(rng, int64(len(f.content)))
+		if !ok {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", len(f.content)))
+			fakeError(w, fakeFailure{http.StatusRequestedRangeNotSatisfiable, "requestedRangeNotSatisfiable"})
+			return
+		}
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(f.content)))
+		body, status = f.content[start:end+1], http.StatusPartialContent
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(status)
+
+	fd.mu.Lock()
+	cut := -1
+	if pending := fd.cuts[id]; len(pending) > 0 {
+		cut, fd.cuts[id] = pending[0], pending[1:]
+	}
+	fd.mu.Unlock()
+	if cut >= 0 && cut < len(body) {
+		w.Write(body[:cut])
+		w.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}
+	w.Write(body)
+}
+
+// parseFakeRange parses a "bytes=start-" or "bytes=start-end" header.
+func parseFakeRange(rng string, size int64) (start, end int64, ok bool) {
+	spec, ok := strings.CutPrefix(rng, "bytes=")
+	if !ok {
+		return 0, 0, false
+	}
+	from, to, _ := strings.Cut(spec, "-")
+	start, err := strconv.ParseInt(from, 10, 64)
+	if err != nil || start >= size {
+		return 0, 0, false
+	}
+	end = size - 1
+	if to != "" {
+		if end, err = strconv.ParseInt(to, 10, 64); err != nil || end < start {
+			return 0, 0, false
+		}
+		end = min(end, size-1)
+	}
+	return start, end, true
+}
+
+func (fd *fakeDrive) serveExport(w http.ResponseWriter, r *http.Request, id string) {
+	f, failure := fd.begin(routeExport, id)
+	if failure != nil {
+		fakeError(w, *failure)
+		return
+	}
+	if f == nil {
+		fakeError(w, fakeFailure{http.StatusNotFound, "notFound"})
+		return
+	}
+	content, ok := f.exports[r.URL.Query().Get("mimeType")]
+	if !ok {
+		fakeError(w, fakeFailure{http.StatusBadRequest, "badRequest"})
+		return
+	}
+	w.Write(content)
+}
+
+// serveList lists the children of the folder named in the query, in one
+// page.
+func (fd *fakeDrive) serveList(w http.ResponseWriter, r *http.Request) {
+	m := fakeParentsQ.FindStringSubmatch(r.URL.Query().Get("q"))
+	if m == nil {
+		fakeError(w, fakeFailure{http.StatusBadRequest, "invalidQuery"})
+		return
+	}
+	if _, failure := fd.begin(routeList, m[1]); failure != nil {
+		fakeError(w, *failure)
+		return
+	}
+	fd.mu.Lock()
+	list := &drive.FileList{Files: []*drive.File{}}
+	for _, f := range fd.files {
+		for _, p := range f.meta.Parents {
+			if p == m[1] {
+				list.Files = append(list.Files, f.meta)
+			}
+		}
+	}
+	fd.mu.Unlock()
+	writeFields(w, r, list)
+}
+
+// serveRevisions lists the revisions of a file, in one page, or serves the
+// content of one of them.
+func (fd *fakeDrive) serveRevisions(w http.ResponseWriter, r *http.Request, id, revID string) {
+	f, failure := fd.begin(routeRevs, id)
+	if failure != nil {
+		fakeError(w, *failure)
+		return
+	}
+	if f == nil {
+		fakeError(w, fakeFailure{http.StatusNotFound, "notFound"})
+		return
+	}
+	fd.mu.Lock()
+	revs := append([]fakeRevision(nil), f.revisions...)
+	fd.mu.Unlock()
+	if revID == "" {
+		list := &drive.RevisionList{Revisions: []*drive.Revision{}}
+		for _, rev := range revs {
+			list.Revisions = append(list.Revisions, rev.meta)
+		}
+		writeFields(w, r, list)
+		return
+	}
+	for _, rev := range revs {
+		if rev.meta.Id == revID {
+			w.Write(rev.content)
+			return
+		}
+	}
+	fakeError(w, fakeFailure{http.StatusNotFound, "notFound"})
+}
+
+// serveComments lists the comments of a file, in one page.
+func (fd *fakeDrive) serveComments(w http.ResponseWriter, r *http.Request, id string) {
+	f, failure := fd.begin(routeCmts, id)
+	if failure != nil {
+		fakeError(w, *failure)
+		return
+	}
+	if f == nil {
+		fakeError(w, fakeFailure{http.StatusNotFound, "notFound"})
+		return
+	}
+	fd.mu.Lock()
+	list := &drive.CommentList{Comments: append([]*drive.Comment{}, f.comments...)}
+	fd.mu.Unlock()
+	writeFields(w, r, list)
+}
+
+func (fd *fakeDrive) serveDrive(w http.ResponseWriter, id string) {
+	if _, failure := fd.begin(routeDrive, id); failure != nil {
+		fakeError(w, *failure)
+		return
+	}
+	fd.mu.Lock()
+	name, ok := fd.drives[id]
+	fd.mu.Unlock()
+	if !ok {
+		fakeError(w, fakeFailure{http.StatusNotFound, "notFound"})
+		return
+	}
+	writeJSON(w, &drive.Drive{Id: id, Name: name})
+}
+
+// serveToken is the OAuth token endpoint, exchanging any refresh token for
+// fakeAccessToken unless refreshFails is set.
+func (fd *fakeDrive) serveToken(w http.ResponseWriter, r *http.Request) {
+	fd.mu.Lock()
+	fd.calls[routeToken+" "]++
+	refuse := fd.refreshFails
+	fd.mu.Unlock()
+	if refuse {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"invalid_grant","error_description":"Token has been expired or revoked."}`))
+		return
+	}
+	writeJSON(w, map[string]any{"access_token": fakeAccessToken, "token_type": "Bearer", "expires_in": 3600})
+}
+
+// writeFields writes v with only the fields the request asked for, as
+// Drive does, so a test sees what a missing field would break.
+func writeFields(w http.ResponseWriter, r *http.Request, v any) {
+	fields := r.URL.Query().Get("fields")
+	if fields == "" {
+		writeJSON(w, v)
+		return
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	var m any
+	if err := json.Unmarshal(b, &m); err != nil {
+		panic(err)
+	}
+	writeJSON(w, selectFields(m, fields))
+}
+
+// selectFields keeps the fields listed in a partial response selector such
+// as "files(id,name),nextPageToken" of a decoded JSON value.
+func selectFields(v any, fields string) any {
+	switch v := v.(type) {
+	case []any:
+		for i := range v {
+			v[i] = selectFields(v[i], fields)
+		}
+		return v
+	case map[string]any:
+		kept := map[string]any{}
+		for _, field := range splitFields(fields) {
+			name, sub, nested := strings.Cut(field, "(")
+			name = strings.TrimSpace(name)
+			value, ok := v[name]
+			if !ok {
+				continue
+			}
+			if nested {
+				value = selectFields(value, strings.TrimSuffix(sub, ")"))
+			}
+			kept[name] = value
+		}
+		return kept
+	}
+	return v
+}
+
+// splitFields splits a selector on the commas outside parentheses.
+func splitFields(fields string) []string {
+	var parts []string
+	depth, start := 0, 0
+	for i, c := range fields {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				parts = append(parts, fields[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, fields[start:])
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// fakeError writes an error in the format of the Drive API.
+func fakeError(w http.ResponseWriter, f fakeFailure) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(f.code)
+	json.NewEncoder(w).Encode(map[string]any{"error": map[string]any{
+		"code":    f.code,
+		"message": f.reason,
+		"errors":  []map[string]string{{"reason": f.reason, "message": f.reason}},
+	}})
+}
+
+// client returns an HTTP client authorized the way gdrive-dl's is: from a
+// saved token whose access token has expired, so the first request goes
+// through the token exchange.
+func (fd *fakeDrive) client() *http.Client {
+	config := &oauth2.Config{
+		ClientID:     "client-id",
+		ClientSecret: "client-secret",
+		Endpoint:     oauth2.Endpoint{TokenURL: fd.URL + "/token"},
+	}
+	tok := &oauth2.Token{AccessToken: "expired", RefreshToken: "refresh-token", Expiry: time.Now().Add(-time.Hour)}
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, fd.Client())
+	return config.Client(ctx, tok)
+}
+
+// downloader returns a downloader talking to the fake Drive with the
+// defaults of the command line, writing under the current directory.
+func (fd *fakeDrive) downloader(t *testing.T) *downloader {
+	t.Helper()
+	client := fd.client()
+	srv, err := drive.NewService(context.Background(), option.WithEndpoint(fd.URL+"/"), option.WithHTTPClient(client))
+	if err != nil {
+		t.Fatal(err)
+	}
+	normalize, err := parseNormalization("nfc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	coll, err := newCollisions(collisionOverwrite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	retry := retrier{maxRetries: 2}
+	return &downloader{
+		srv:         srv,
+		client:      client,
+		parents:     newParentCache(srv, retry),
+		normalize:   normalize,
+		namer:       folderNamer{},
+		collisions:  coll,
+		stats:       newStats(),
+		retry:       retry,
+		buffers:     newBufferPool(32 * 1024),
+		newFileMode: 0666,
+		dirMode:     0755,
+	}
+}
+
+// seedFixtures fills fd with the standard fixtures: nested folders in My
+// Drive, a native Doc, a large file to fetch in ranges and a folder in a
+// shared drive.
+func seedFixtures(fd *fakeDrive) {
+	fd.addFolder("folderA", "A", "")
+	fd.addFolder("folderB", "B", "folderA")
+	fd.addFile("small", "small.txt", "folderB", []byte("hello, drive\n"))
+	fd.addNative("doc", "Notes", "folderA", googleDocMimeType, map[string][]byte{
+		fakeDocxMimeType:  []byte("docx bytes"),
+		"application/pdf": []byte("%PDF-1.4 pdf bytes"),
+	})
+	fd.addFile("large", "large.bin", "folderB", largeFixture)
+	fd.addDrive("sharedDrive", "Team")
+	fd.addFolder("teamFolder", "Reports", "sharedDrive")
+	fd.addFile("report", "report.csv", "teamFolder", []byte("a,b\n1,2\n"))
+}
+
+// largeFixture is the content of the large fixture file, long enough to be
+// fetched in several ranges and with no repeating stretch a misplaced range
+// could hide in.
+var largeFixture = func() []byte {
+	b := make([]byte, 3<<20)
+	x := uint32(1)
+	for i := range b {
+		x ^= x << 13
+		x ^= x >> 17
+		x ^= x << 5
+		b[i] = byte(x)
+	}
+	return b
+}()
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"strings"
+
+	"google.golang.org/api/googleapi"
+)
+
+// baseFileFields are requested for every file regardless of the options.
+var baseFileFields = []string{"id", "name", "mimeType", "size"}
+
+// parentFields is all the folder path walk needs from each ancestor.
+const parentFields = "name,parents"
+
+// fileFields returns the metadata fields the enabled options need. Options
+// that depend on extra metadata add their fields here rather than at the call
+// sites, so each metadata call only carries what will actually be used.
+func (d *downloader) fileFields() googleapi.Field {
+	fields := append([]string(nil), baseFileFields...)
+	if !d.noPath {
+		fields = append(fields, "parents", "driveId")
+	} else if d.driveIDs {
+		fields = append(fields, "driveId")
+	}
+	if d.organizeShared {
+		fields = append(fields, "sharedWithMeTime")
+	}
+	if d.organizeShared || d.catalog || d.templated {
+		fields = append(fields, "owners(emailAddress)")
+	}
+	if d.templated {
+		fields = append(fields, "createdTime")
+	}
+	checksums := d.skipMatch == skipMatchChecksum
+	if d.verifyOnly || d.dryRun || d.verifyMD5 || d.cas != nil || d.catalog || d.indexed || d.keepPartial || d.parts > 1 || checksums {
+		fields = append(fields, "md5Checksum")
+	}
+	if d.catalog || d.indexed || d.keepPartial || checksums || d.templated || !d.modifiedAfter.IsZero() || d.orderBy == fileOrders["modified"].listing {
+		fields = append(fields, "modifiedTime")
+	}
+	if d.readonlyIfView {
+		fields = append(fields, "capabilities(canEdit)")
+	}
+	// Export links only come with native files, and let types outside the
+	// export map be exported too.
+	fields = append(fields, "exportLinks")
+	fields = append(fields, d.extraFields...)
+	return googleapi.Field(strings.Join(fields, ","))
+}
@@ -0,0 +1,13 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDryRunRequestsChecksums(t *testing.T) {
+	d := &downloader{dryRun: true}
+	if fields := string(d.fileFields()); !strings.Contains(fields, "md5Checksum") {
+		t.Errorf("--dry-run requests %s, without md5Checksum", fields)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// idFilter restricts the work to, or excludes, sets of file IDs loaded from
+// --only-ids and --exclude-ids.
+type idFilter struct {
+	only     map[string]bool // nil when every ID is allowed
+	exclude  map[string]bool
+	included atomic.Int64
+	excluded atomic.Int64
+}
+
+// newIDFilter loads the ID sets from their files; an empty path means no
+// such set.
+func newIDFilter(onlyPath, excludePath string) (*idFilter, error) {
+	f := &idFilter{}
+	var err error
+	if onlyPath != "" {
+		if f.only, err = loadIDs(onlyPath); err != nil {
+			return nil, err
+		}
+	}
+	if excludePath != "" {
+		if f.exclude, err = loadIDs(excludePath); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// loadIDs reads one ID per line, ignoring blank lines and # comments.
+func loadIDs(path string) (map[string]bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open ID list: %v", err)
+	}
+	defer f.Close()
+	ids := map[string]bool{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			ids[line] = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("unable to read ID list %s: %v", path, err)
+	}
+	return ids, nil
+}
+
+// active reports whether any ID set was given.
+func (f *idFilter) active() bool {
+	return f.only != nil || f.exclude != nil
+}
+
+// excludes reports whether id is on the exclude list. Excluding a folder
+// skips everything in it.
+func (f *idFilter) excludes(id string) bool {
+	return f.exclude[id]
+}
+
+// allows reports whether the file id passes --only-ids. Folders are not
+// subject to it, so that their contents can still be filtered.
+func (f *idFilter) allows(id string) bool {
+	return f.only == nil || f.only[id]
+}
+
+// count records the decision taken for an entry, once per entry, for
+// logSummary. The checks themselves run wherever they save work, several
+// times for the same entry.
+func (f *idFilter) count(included bool) {
+	if included {
+		f.included.Add(1)
+	} else {
+		f.excluded.Add(1)
+	}
+}
+
+// logSummary logs how many files the ID lists let through.
+func (f *idFilter) logSummary() {
+	if f.active() {
+		log.Printf("ID filters: %d included, %d excluded", f.included.Load(), f.excluded.Load())
+	}
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"golang.org/x/sync/semaphore"
+	"google.golang.org/api/drive/v3"
+)
+
+func TestFilterCountsEachFileOnce(t *testing.T) {
+	f := &idFilter{only: map[string]bool{"kept": true}, exclude: map[string]bool{"excluded": true}}
+	ctx := context.Background()
+	p := &pipeline{d: &downloader{}, filter: f, maxFiles: 10, metaSem: semaphore.NewWeighted(1), start: ctx}
+	for _, id := range []string{"excluded", "other"} {
+		// Listed files are checked by admit, then by process.
+		p.submit(ctx, inputEntry{id: id, file: &drive.File{Id: id, MimeType: "text/plain"}}, nil)
+	}
+	p.wg.Wait()
+	if in, out := f.included.Load(), f.excluded.Load(); in != 0 || out != 2 {
+		t.Errorf("counted %d included and %d excluded, want 0 and 2", in, out)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"google.golang.org/api/drive/v3"
+)
+
+// gzipMagic starts every gzip stream.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// errNotGzip is --gunzip given content that is not gzip-compressed.
+// Downloading it again would not change that, so it fails the file for good.
+var errNotGzip = errors.New("not gzip-compressed, cannot --gunzip it")
+
+// gzipExt is stripped by --gunzip and added by --gzip.
+const gzipExt = ".gz"
+
+// compressedName adjusts an output path for --gunzip or --gzip.
+func (d *downloader) compressedName(dest string) string {
+	switch {
+	case d.gunzip:
+		return strings.TrimSuffix(dest, gzipExt)
+	case d.gzip:
+		return dest + gzipExt
+	}
+	return dest
+}
+
+// copyTransformed writes src to out decompressed (--gunzip) or
+// compressed (--gzip), and closes it. It returns the number of bytes read
+// from Drive, which is what checkSize compares with the file's size. A
+// broken stream is resumed from the source's offset underneath the
+// transform, except for exports, which fail the file.
+func (d *downloader) copyTransformed(ctx context.Context, file *drive.File, out io.Writer, src *resumingReader, t *transfer) (int64, error) {
+	defer src.Close()
+	buf := d.buffers.Get().(*[]byte)
+	defer d.buffers.Put(buf)
+
+	dst := countingWriter{out, t}
+	if d.gunzip {
+		br := bufio.NewReader(src)
+		if magic, err := br.Peek(len(gzipMagic)); err != nil || !bytes.Equal(magic, gzipMagic) {
+			return src.read, fmt.Errorf("%s is %w", file.Name, errNotGzip)
+		}
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return src.read, err
+		}
+		if _, err := io.CopyBuffer(dst, zr, *buf); err != nil {
+			return src.read, err
+		}
+		return src.read, zr.Close()
+	}
+
+	zw := gzip.NewWriter(dst)
+	if _, err := io.CopyBuffer(zw, src, *buf); err != nil {
+		return src.read, err
+	}
+	return src.read, zw.Close()
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"slices"
+	"strings"
+)
+
+// streamHashers are the checksums --stream-hash can compute.
+var streamHashers = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha256": sha256.New,
+}
+
+// parseStreamHashes parses a comma separated --stream-hash list.
+func parseStreamHashes(s string) ([]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var names []string
+	for _, name := range strings.Split(s, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if _, ok := streamHashers[name]; !ok {
+			return nil, fmt.Errorf("invalid --stream-hash %q, expected md5, sha256 or md5,sha256", s)
+		}
+		if !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// hashNames returns the checksums computed over each download: the ones
+// --stream-hash asks for, and md5 for --verify, which then needs no
+// separate read of the file.
+func (d *downloader) hashNames() []string {
+	if d.verifyMD5 && !slices.Contains(d.streamHashes, "md5") {
+		return append(slices.Clone(d.streamHashes), "md5")
+	}
+	return d.streamHashes
+}
+
+// streamHash is a checksum of a download computed as it is written.
+type streamHash struct {
+	name string
+	h    hash.Hash
+}
+
+// startHashes makes t hash what is written with each of the named
+// algorithms.
+func (t *transfer) startHashes(names []string) {
+	t.hashMu.Lock()
+	defer t.hashMu.Unlock()
+	t.hashNames = names
+	t.restartHashes()
+}
+
+// restartHashes starts the hashes over, for a transfer written again from
+// the first byte. hashMu must be held.
+func (t *transfer) restartHashes() {
+	t.hashes = t.hashes[:0]
+	for _, name := range t.hashNames {
+		t.hashes = append(t.hashes, streamHash{name, streamHashers[name]()})
+	}
+	t.hashValid = len(t.hashes) > 0
+}
+
+// hashWrite adds written bytes to the hashes.
+func (t *transfer) hashWrite(p []byte) {
+	t.hashMu.Lock()
+	defer t.hashMu.Unlock()
+	if !t.hashValid {
+		return
+	}
+	for _, s := range t.hashes {
+		s.h.Write(p)
+	}
+}
+
+// skipHashes gives up hashing a transfer that does not write the file from
+// its first byte, as when resuming a partial download; the hashes would not
+// be the file's.
+func (t *transfer) skipHashes() {
+	t.hashMu.Lock()
+	defer t.hashMu.Unlock()
+	t.hashValid = false
+}
+
+// sum returns the hex digest of the named hash of what was written so far,
+// if it is being computed over the whole file.
+func (t *transfer) sum(name string) (string, bool) {
+	t.hashMu.Lock()
+	defer t.hashMu.Unlock()
+	if !t.hashValid {
+		return "", false
+	}
+	for _, s := range t.hashes {
+		if s.name == name {
+			return hex.EncodeToString(s.h.Sum(nil)), true
+		}
+	}
+	return "", false
+}
+
+// sums describes the hashes of what was written so far, e.g.
+// "md5 9e10...8a1f, sha256 3b4c...", or is empty if there are none.
+func (t *transfer) sums() string {
+	t.hashMu.Lock()
+	defer t.hashMu.Unlock()
+	if !t.hashValid {
+		return ""
+	}
+	parts := make([]string, len(t.hashes))
+	for i, s := range t.hashes {
+		parts[i] = s.name + " " + hex.EncodeToString(s.h.Sum(nil))
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	_ "modernc.org/sqlite" // pure Go, no cgo
+)
+
+// indexMigrations bring an --index-db database up to date, one schema
+// version each; the database's user_version is the number applied. New
+// versions are only ever appended.
+var indexMigrations = []string{
+	`CREATE TABLE files (
+		id            TEXT PRIMARY KEY,
+		name          TEXT NOT NULL,
+		path          TEXT NOT NULL,
+		size          INTEGER NOT NULL,
+		md5           TEXT NOT NULL,
+		modified_time TEXT NOT NULL,
+		downloaded_at TEXT NOT NULL
+	);
+	CREATE INDEX files_path ON files (path);`,
+}
+
+// index is the SQLite database of downloaded files kept with --index-db.
+type index struct {
+	db *sql.DB
+}
+
+// openIndex opens or creates the database at path and migrates it to the
+// current schema.
+func openIndex(path string) (*index, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open index database: %v", err)
+	}
+	// SQLite has a single writer anyway, and one connection avoids
+	// SQLITE_BUSY between the download goroutines.
+	db.SetMaxOpenConns(1)
+	if err := migrateIndex(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &index{db: db}, nil
+}
+
+func migrateIndex(db *sql.DB) error {
+	var version int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return fmt.Errorf("unable to read index database version: %v", err)
+	}
+	if version > len(indexMigrations) {
+		return fmt.Errorf("index database has schema version %d, newer than this gdrive-dl supports (%d)", version, len(indexMigrations))
+	}
+	for v := version; v < len(indexMigrations); v++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return fmt.Errorf("unable to migrate index database: %v", err)
+		}
+		if _, err := tx.Exec(indexMigrations[v]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("unable to migrate index database to version %d: %v", v+1, err)
+		}
+		if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", v+1)); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("unable to migrate index database to version %d: %v", v+1, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("unable to migrate index database to version %d: %v", v+1, err)
+		}
+	}
+	return nil
+}
+
+// record upserts a downloaded file.
+func (x *index) record(res *result) error {
+	file := res.file
+	_, err := x.db.Exec(`INSERT INTO files (id, name, path, size, md5, modified_time, downloaded_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET
+			name = excluded.name, path = excluded.path, size = excluded.size, md5 = excluded.md5,
+			modified_time = excluded.modified_time, downloaded_at = excluded.downloaded_at`,
+		file.Id, file.Name, res.Path, res.Bytes, file.Md5Checksum, file.ModifiedTime, time.Now().UTC().Format(time.RFC3339))
+	if err != nil {
+		return fmt.Errorf("unable to record %s in the index database: %v", file.Id, err)
+	}
+	return nil
+}
+
+func (x *index) Close() error {
+	return x.db.Close()
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"google.golang.org/api/drive/v3"
+)
+
+// inputEntry is one line of input: a file ID and, optionally, the path to
+// write it to instead of the one reconstructed from Drive.
+type inputEntry struct {
+	id     string
+	output string
+	// file is the metadata of the entry when it is already known, as for the
+	// contents of a walked folder.
+	file *drive.File
+	// parent is the ID of the walked folder the entry was listed in, empty
+	// for entries given as input.
+	parent string
+	// dir, for files linked from a Doc, is the companion folder to write
+	// the file into, under its own name.
+	dir string
+	// retry marks an entry given another go after its folder path could not
+	// be resolved the first time.
+	retry bool
+}
+
+// What --on-empty-input does when the input has no entries at all.
+const (
+	onEmptyWarn  = "warn"
+	onEmptyError = "error"
+)
+
+func parseOnEmptyInput(s string) (string, error) {
+	switch s {
+	case onEmptyWarn, onEmptyError:
+		return s, nil
+	}
+	return "", fmt.Errorf("invalid --on-empty-input %q, expected %s or %s", s, onEmptyWarn, onEmptyError)
+}
+
+// parseEntry splits an "ID|relative/output/path" line. Drive IDs never
+// contain "|", so everything after the first one belongs to the path and a
+// literal "|" in the path needs no escaping: "ID|a|b.txt" writes "a|b.txt".
+// The ID may also be a link to the file (see parseInputID); a link it does
+// not recognize is reported and the line skipped.
+func parseEntry(line string) inputEntry {
+	id, output, _ := strings.Cut(line, "|")
+	id, err := parseInputID(strings.TrimSpace(id))
+	if err != nil {
+		log.Printf("Warning: skipping input line: %v", err)
+		return inputEntry{}
+	}
+	return inputEntry{id: id, output: output}
+}
+
+// linkIDPattern matches the IDs in the paths of Drive links, as in
+// drive.google.com/file/d/<id>/view, docs.google.com/document/d/<id>/edit
+// and drive.google.com/drive/folders/<id>.
+var linkIDPattern = regexp.MustCompile(`^/(?:(?:file|document|spreadsheets|presentation|drawings|forms)/d|drive(?:/u/\d+)?/folders)/([A-Za-z0-9_-]{10,})(?:/|$)`)
+
+// parseInputID returns the file ID of an input entry, which is either an ID
+// or a link copied from Drive: a share link, or a webContentLink such as
+// drive.google.com/uc?id=<id>&export=download or
+// drive.usercontent.google.com/download?id=<id>&confirm=t. Confirm tokens
+// and other parameters are dropped; they only get past the virus scan
+// page of the website, which the API does not show.
+func parseInputID(s string) (string, error) {
+	if !strings.HasPrefix(s, "https://") && !strings.HasPrefix(s, "http://") {
+		return s, nil
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return "", fmt.Errorf("invalid link %q: %v", s, err)
+	}
+	switch u.Host {
+	case "drive.google.com", "docs.google.com", "drive.usercontent.google.com":
+		if id := u.Query().Get("id"); id != "" {
+			return id, nil
+		}
+		if m := linkIDPattern.FindStringSubmatch(u.Path); m != nil {
+			return m[1], nil
+		}
+	}
+	return "", fmt.Errorf("no file ID found in link %q, give the file ID instead", s)
+}
+
+// scanNUL is a bufio.SplitFunc that splits input on NUL bytes, for use with
+// find -print0 style producers. A final unterminated token is still returned.
+func scanNUL(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+	if i := bytes.IndexByte(data, 0); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+	if atEOF {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// jsonEntry is one object of an --input-json file.
+type jsonEntry struct {
+	ID     string `json:"id"`
+	Output string `json:"output"`
+	// Export is the format a native file is exported as, by extension
+	// (pdf, docx, ...) or MIME type.
+	Export string `json:"export"`
+	// DownloadAs is the MIME type a stored file is treated as, as with
+	// --download-as.
+	DownloadAs string `json:"download_as"`
+	Skip       bool   `json:"skip"`
+}
+
+// loadInputJSON reads an --input-json file: an array of entries with
+// per-file overrides. Every malformed entry is reported, not just the first.
+// Export and download type overrides are returned by file ID, and skipped
+// entries are left out.
+func loadInputJSON(path string) ([]inputEntry, map[string]exportFormat, map[string]string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("unable to read input file: %v", err)
+	}
+	var raw []json.RawMessage
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid input file %s, expected a JSON array of objects: %v", path, err)
+	}
+
+	var entries []inputEntry
+	formats := map[string]exportFormat{}
+	types := map[string]string{}
+	var problems []string
+	skipped := 0
+	for i, r := range raw {
+		var e jsonEntry
+		dec := json.NewDecoder(bytes.NewReader(r))
+		dec.DisallowUnknownFields()
+		err := dec.Decode(&e)
+		switch {
+		case err != nil:
+		case strings.TrimSpace(e.ID) == "":
+			err = errors.New(`"id" is missing`)
+		case e.Output != "" && !filepath.IsLocal(e.Output):
+			err = fmt.Errorf("output path %q must be relative and stay inside the output directory", e.Output)
+		default:
+			e.ID, err = parseInputID(strings.TrimSpace(e.ID))
+		}
+		var format exportFormat
+		if err == nil && e.Export != "" {
+			format, err = parseExportName(e.Export)
+		}
+		if err == nil && e.DownloadAs != "" {
+			_, err = parseDownloadAs(e.DownloadAs)
+		}
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("entry %d: %v", i, err))
+			continue
+		}
+		if e.Skip {
+			skipped++
+			continue
+		}
+		id := strings.TrimSpace(e.ID)
+		if e.Export != "" {
+			formats[id] = format
+		}
+		if e.DownloadAs != "" {
+			types[id] = e.DownloadAs
+		}
+		entries = append(entries, inputEntry{id: id, output: e.Output})
+	}
+	if len(problems) > 0 {
+		return nil, nil, nil, fmt.Errorf("invalid input file %s:\n  %s", path, strings.Join(problems, "\n  "))
+	}
+	if skipped > 0 {
+		log.Printf("Skipping %d entries marked \"skip\" in %s", skipped, path)
+	}
+	return entries, formats, types, nil
+}
+
+// parseExportName returns the export format named by an extension such as
+// pdf or .docx, or by a MIME type.
+func parseExportName(name string) (exportFormat, error) {
+	if strings.Contains(name, "/") {
+		return exportFormat{name, extensionFor(name)}, nil
+	}
+	ext := "." + strings.TrimPrefix(strings.ToLower(name), ".")
+	for mimeType, e := range exportExtensions {
+		if e == ext {
+			return exportFormat{mimeType, ext}, nil
+		}
+	}
+	return exportFormat{}, fmt.Errorf("unknown export format %q, use a MIME type", name)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// maxLinkScan bounds how much of a Doc's HTML export is scanned for links.
+const maxLinkScan = 32 << 20
+
+// driveLinkPattern matches the usual ways a Drive file is linked from a Doc:
+// drive.google.com/file/d/<id>, docs.google.com/<type>/d/<id> and
+// ...?id=<id>, including smart chips, which export as links too.
+var driveLinkPattern = regexp.MustCompile(`https?://(?:drive|docs)\.google\.com/(?:(?:file|document|spreadsheets|presentation|drawings)/d/|(?:open|uc)\?(?:[^"'\s<>]*&amp;|[^"'\s<>]*&)?id=)([A-Za-z0-9_-]{10,})`)
+
+// googleDocMimeType is the only type whose links are followed.
+const googleDocMimeType = "application/vnd.google-apps.document"
+
+// linkedFilesDir returns the companion folder the linked files of the Doc
+// written to dest go to, e.g. Report_files for Report.docx.
+func linkedFilesDir(dest string) string {
+	return strings.TrimSuffix(dest, filepath.Ext(dest)) + "_files"
+}
+
+// downloadLinked finds the Drive files a Google Doc links to and submits
+// them to be written into the Doc's companion folder.
+//
+// Links are found in the Doc's HTML export, so only links in the body are
+// seen, not those in comments. Links to the Doc itself are ignored, and
+// linked files are not searched for links of their own. Files the user
+// cannot access fail like any other input.
+func (p *pipeline) downloadLinked(ctx context.Context, docID, dest string) error {
+	var resp *http.Response
+	err := p.d.retry.do(ctx, docID, func() (err error) {
+		resp, err = p.d.srv.Files.Export(docID, "text/html").Context(ctx).Download()
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("unable to export document to find its links: %v", err)
+	}
+	defer resp.Body.Close()
+	html, err := io.ReadAll(io.LimitReader(resp.Body, maxLinkScan))
+	if err != nil {
+		return fmt.Errorf("unable to export document to find its links: %v", err)
+	}
+
+	dir := linkedFilesDir(dest)
+	seen := map[string]bool{docID: true}
+	for _, m := range driveLinkPattern.FindAllSubmatch(html, -1) {
+		id := string(m[1])
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		p.submit(ctx, inputEntry{id: id, dir: dir}, nil)
+	}
+	if n := len(seen) - 1; n > 0 {
+		log.Printf("%s: downloading %d linked files into %s", docID, n, dir)
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
+)
+
+// --on-ambiguous policies, for names that match several files.
+const (
+	ambiguousError = "error"
+	ambiguousAll   = "all"
+)
+
+func parseOnAmbiguous(s string) (string, error) {
+	switch s {
+	case ambiguousError, ambiguousAll:
+		return s, nil
+	}
+	return "", fmt.Errorf("invalid --on-ambiguous %q, expected %s or %s", s, ambiguousError, ambiguousAll)
+}
+
+// nameLookup resolves input names to the files of that name in a folder,
+// for --folder.
+type nameLookup struct {
+	folder      string
+	onAmbiguous string
+}
+
+// escapeQuery escapes a string for use inside a quoted Drive query literal.
+func escapeQuery(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s)
+}
+
+// lookup lists the files named entry.id in the --folder and submits each
+// match as an entry of its own.
+func (p *pipeline) lookup(ctx context.Context, entry inputEntry) *result {
+	res := &result{ID: entry.id, Name: entry.id}
+	if err := p.metaSem.Acquire(p.start, 1); err != nil {
+		return p.interrupted(res)
+	}
+	query := fmt.Sprintf("name = '%s' and '%s' in parents and trashed = false", escapeQuery(entry.id), escapeQuery(p.names.folder))
+	fields := googleapi.Field("nextPageToken,files(" + string(p.d.fileFields()) + ")")
+	var matches []*drive.File
+	err := p.d.retry.do(ctx, entry.id, func() error {
+		matches = nil
+		return p.d.list(query).Fields(fields).Context(ctx).
+			Pages(ctx, func(list *drive.FileList) error {
+				matches = append(matches, list.Files...)
+				return nil
+			})
+	})
+	p.metaSem.Release(1)
+	if err != nil {
+		return p.fail(ctx, res, fmt.Errorf("unable to look up file by name: %v", err))
+	}
+
+	switch {
+	case len(matches) == 0:
+		return p.fail(ctx, res, fmt.Errorf("no file named %q in folder %s", entry.id, p.names.folder))
+	case len(matches) > 1 && p.names.onAmbiguous == ambiguousError:
+		ids := make([]string, len(matches))
+		for i, f := range matches {
+			ids[i] = f.Id
+		}
+		return p.fail(ctx, res, fmt.Errorf("%d files are named %q in folder %s (%s), use --on-ambiguous=all to download them all", len(matches), entry.id, p.names.folder, strings.Join(ids, ", ")))
+	case len(matches) > 1 && entry.output != "":
+		return p.fail(ctx, res, fmt.Errorf("%d files are named %q, they cannot all be written to %s", len(matches), entry.id, entry.output))
+	}
+	for _, f := range matches {
+		p.submit(ctx, inputEntry{id: f.Id, output: entry.output, file: f}, nil)
+	}
+	return nil
+}
@@ -4,47 +4,69 @@ import (
 	"bufio"
 	"context"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strings"
-	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
 	"golang.org/x/sync/semaphore"
 	"google.golang.org/api/drive/v3"
 	"google.golang.org/api/option"
+	"google.golang.org/api/sheets/v4"
 )
 
 // Define the scope for read-only metadata access
 const driveMetadataScope = "https://www.googleapis.com/auth/drive.readonly"
 
+// exitDeadline is the exit status when --timeout-total cut the run short.
+const exitDeadline = 4
+
+// version is reported in the default User-Agent, set at build time with
+// -ldflags "-X main.version=...".
+var version = "dev"
+
 // getClient uses a client ID and secret to retrieve a token
 // from a web flow, then saves the token to a file.
-func getClient(config *oauth2.Config) *http.Client {
-	// The file token.json stores the user's access and refresh tokens.
-	tokFile := "token.json"
+func getClient(config *oauth2.Config, tokFile string) *http.Client {
+	if tok, ok, err := tokenFromEnv(); ok {
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := checkToken(config, tok); isTokenExpired(err) {
+			log.Printf("The token in %s has expired or was revoked, authorize gdrive-dl again", tokenEnv)
+			os.Exit(exitTokenExpired)
+		}
+		return config.Client(context.Background(), tok)
+	}
 	tok, err := tokenFromFile(tokFile)
 	if err != nil {
-		tok = getTokenFromWeb(config)
+		tok = getTokenFromWeb(config, os.Stdin, os.Stdout)
 		saveToken(tokFile, tok)
+	} else if err := checkToken(config, tok); isTokenExpired(err) {
+		tok = reauthorize(config, tokFile)
 	}
 	return config.Client(context.Background(), tok)
 }
 
-// getTokenFromWeb retrieves a token from a web-based authorization flow.
-func getTokenFromWeb(config *oauth2.Config) *oauth2.Token {
+// getTokenFromWeb retrieves a token from a web-based authorization flow,
+// reading the code from in.
+func getTokenFromWeb(config *oauth2.Config, in io.Reader, out io.Writer) *oauth2.Token {
 	authURL := config.AuthCodeURL("state-token", oauth2.AccessTypeOffline)
-	fmt.Printf("Go to the following link in your browser:\n%v\n", authURL)
-	fmt.Print("Then type the authorization code: ")
+	fmt.Fprintf(out, "Go to the following link in your browser:\n%v\n", authURL)
+	fmt.Fprint(out, "Then type the authorization code: ")
 
 	var authCode string
-	if _, err := fmt.Scan(&authCode); err != nil {
+	if _, err := fmt.Fscan(in, &authCode); err != nil {
 		log.Fatalf("Unable to read authorization code: %v", err)
 	}
 
@@ -78,17 +100,42 @@ func saveToken(path string, token *oauth2.Token) {
 	json.NewEncoder(f).Encode(token)
 }
 
+// newDriveService builds the Drive client on top of the authorized HTTP
+// client, tagging every request with the given User-Agent.
+func newDriveService(ctx context.Context, client *http.Client, userAgent string) (*drive.Service, error) {
+	client.Transport = &userAgentTransport{userAgent: userAgent, base: client.Transport}
+	return drive.NewService(ctx, option.WithHTTPClient(client))
+}
+
 // getFolderPath recursively fetches parent folders to build the full path.
-func getFolderPath(srv *drive.Service, file *drive.File) (string, error) {
+//
+// In My Drive the chain ends at a folder without parents. Items in a shared
+// drive end at the drive's root folder instead, whose ID is the driveId; it
+// is named after the shared drive and ends the path.
+func getFolderPath(ctx context.Context, parents *parentCache, file *drive.File) (string, error) {
 	if len(file.Parents) == 0 {
 		return "", nil // File is in the root
 	}
 
 	var pathParts []string
 	parentID := file.Parents[0] // Use the first parent
+	seen := map[string]bool{}
 
 	for {
-		parent, err := srv.Files.Get(parentID).Fields("name,parents").Do()
+		if file.DriveId != "" && parentID == file.DriveId {
+			name, err := parents.sharedDriveName(ctx, parentID)
+			if err != nil {
+				return "", fmt.Errorf("unable to retrieve shared drive: %v", err)
+			}
+			pathParts = append([]string{name}, pathParts...)
+			break // Reached the shared drive's root
+		}
+		if seen[parentID] {
+			return "", fmt.Errorf("folder %s is its own ancestor", parentID)
+		}
+		seen[parentID] = true
+
+		parent, err := parents.get(ctx, parentID)
 		if err != nil {
 			return "", fmt.Errorf("unable to retrieve parent folder: %v", err)
 		}
@@ -104,28 +151,620 @@ func getFolderPath(srv *drive.Service, file *drive.File) (string, error) {
 	return strings.Join(pathParts, "/"), nil
 }
 
+// usage documents the input format along with the flags.
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), `Usage: %s [flags] < ids.txt
+
+Downloads the Drive files whose IDs are read from stdin, one per line.
+The ID "root" stands for the files in the My Drive root, and with
+--recursive for everything in My Drive.
+
+A line may also be "ID|relative/output/path" to choose where that file is
+written, bypassing folder reconstruction. Everything after the first "|" is
+the path, so a path containing "|" needs no escaping.
+
+The client secret is read from ~/.credentials.json and the token from
+token.json, unless GDRIVE_CREDENTIALS_JSON and GDRIVE_TOKEN_JSON hold their
+JSON content. A token from the environment is never written to disk.
+If the token can no longer be refreshed, the token file is moved aside and
+authorization runs again on the terminal; without one, or for a token from
+the environment, gdrive-dl exits with status 3.
+
+Flags:
+`, os.Args[0])
+	flag.PrintDefaults()
+}
+
 func main() {
-	ctx := context.Background()
+	runStarted := time.Now()
+	failFast := flag.Bool("fail-fast", false, "Abort the whole batch on the first per-file error")
+	userAgent := flag.String("user-agent", "gdrive-dl/"+version, "User-Agent sent with every API request")
+	normalization := flag.String("normalize-unicode", "nfc", "Unicode normalization applied to file and folder names: nfc, nfd or none")
+	maxRetries := flag.Int("max-retries", 0, "Retry transient API errors and not-yet-ready files up to this many times")
+	flatten := flag.Bool("flatten", false, "Write every file into the current directory instead of recreating its Drive folders")
+	logFile := flag.String("logfile", "", "Also append log output to this file")
+	logFileMaxSize := flag.Int64("logfile-max-size", 0, "Rotate the log file to <logfile>.1 once it exceeds this many megabytes (0 disables rotation)")
+	stdinNull := flag.Bool("stdin-null", false, "Input entries are separated by NUL bytes instead of newlines")
+	maxLineSize := flag.Int("max-line-size", 1<<20, "Longest input entry accepted, in bytes")
+	resolveOnly := flag.Bool("resolve-only", false, "Print <id>\t<path> for every input without downloading anything")
+	bufferSize := flag.Int("buffer-size", 32*1024, "Size in bytes of the buffer used to copy each download to disk")
+	noPath := flag.Bool("no-path", false, "Like --flatten, but skip looking up parent folders altogether, saving API calls")
+	minFreeSpace := flag.String("min-free-space", "0", "Pause new downloads while the disk of the output, --staging-dir, --exports-dir or --cas-store has less free space than this, e.g. 10G")
+	minFreeTimeout := flag.Duration("min-free-space-timeout", 30*time.Minute, "How long a pause for disk space may last before the downloads waiting on it fail")
+	exportsDir := flag.String("exports-dir", "", "Write exported Google Docs, Sheets and Slides under this directory, keeping their folder path (or just the name with --flatten)")
+	strictSize := flag.Bool("strict-size", false, "Treat a download whose size differs from Drive's metadata as failed (and retry it with --max-retries)")
+	trashAfter := flag.Bool("trash-after-download", false, "Move each file to the Drive trash once it has been downloaded (requires full Drive access, and --collision=rename or hash)")
+	yes := flag.Bool("yes", false, "Do not ask for confirmation before destructive actions")
+	collision := flag.String("collision", collisionOverwrite, "What to do when two files map to the same path: overwrite, rename (adds \" (1)\") or hash (adds a short hash of the file ID to every name, the same on every run)")
+	organizeShared := flag.Bool("organize-shared", false, "Put files shared with you under shared/<owner email>/ instead of resolving their folders")
+	skipExisting := flag.Bool("skip-existing", false, "Do not download files that are already present at their output path")
+	skipMatch := flag.String("skip-match", skipMatchExists, "How --skip-existing recognizes a present file: exists (any file at the path) name-size (same path and byte size) or checksum (same md5, or for Google Docs a local copy newer than the last change)")
+	concurrency := flag.Int("concurrency", 10, "Number of files downloaded at the same time")
+	metadataConcurrency := flag.Int("metadata-concurrency", 10, "Number of files whose metadata and folder path are resolved at the same time")
+	stagingDir := flag.String("staging-dir", "", "Download into this directory first and move each file into the output tree only when complete (must be on the same filesystem)")
+	statusAddr := flag.String("status-addr", "", "Serve the progress of the run as JSON on this address, e.g. :8080")
+	onDirConflict := flag.String("on-dir-conflict", dirConflictError, "When a folder in the output path already exists as a file: error, or rename the folder to <name>_dir")
+	recursive := flag.Bool("recursive", false, "Download the contents of folders given as input, including subfolders")
+	statePath := flag.String("state", "", "With --recursive, save the folder traversal progress to this file and resume from it on the next run")
+	verifyOnly := flag.Bool("verify-only", false, "Check existing local files against Drive's size and md5 instead of downloading, printing OK, MISMATCH, MISSING or UNCHECKED for each")
+	repair := flag.Bool("repair", false, "With --verify-only, download again the files that are missing or do not match")
+	casDir := flag.String("cas-store", "", "Store each distinct content once under <dir>/objects/<md5 prefix>/<md5>, with logical paths listed in <dir>/manifest.md5")
+	progressInterval := flag.Duration("progress-interval", 0, "Log the progress, rate and ETA of every download in flight this often, e.g. 30s (0 disables)")
+	onlyIDs := flag.String("only-ids", "", "Only download files whose IDs are listed in this file, one per line (folders are still walked)")
+	excludeIDs := flag.String("exclude-ids", "", "Skip files and folders whose IDs are listed in this file, one per line")
+	withComments := flag.Bool("export-comments", false, "Save each file's comments and replies to a <name>.comments.json sidecar")
+	var exportOptions stringList
+	flag.Var(&exportOptions, "export-option", "Pass an export option for a native type through to its export link, e.g. spreadsheet:gridlines=false; Files.Export takes no options, and which keys the link honours is up to Google (repeatable)")
+	var includeFields stringList
+	maxRuntime := flag.Duration("max-runtime", 0, "Stop starting new downloads after this long, e.g. 45m, and exit once those in flight are done (0 disables)")
+	grace := flag.Duration("grace", 0, "With --max-runtime, how long downloads in flight may still take before they are cancelled (0 waits for them)")
+	reportPath := flag.String("report", "", "Write a JSON report of every file's outcome, and whether the run completed, to this file")
+	chmod := flag.String("chmod", "", "Set the permission bits of every downloaded file, in octal, e.g. 0640 (default: as created, 0666 less the umask)")
+	readonlyIfView := flag.Bool("readonly-if-view", false, "Make files you can only view on Drive read-only (0444) and the ones you can edit 0644")
+	gunzip := flag.Bool("gunzip", false, "Decompress gzip-compressed files while downloading them, dropping the .gz suffix from their names")
+	gzipFiles := flag.Bool("gzip", false, "Compress every file with gzip while downloading it, adding a .gz suffix to its name")
+	dryRun := flag.Bool("dry-run", false, "Print a plan of what would change in the output tree as add, update and keep lines, without downloading anything; with --recursive, delete lines list local files the input folders no longer have")
+	deleteExtraneous := flag.Bool("delete-extraneous", false, "With --recursive, delete local files under the input folders' directories that are no longer in Drive, once every folder was downloaded without errors (preview with --dry-run)")
+	outputFormat := flag.String("output-format", outputText, "What is written to stdout: text, or ndjson for one JSON object per file as it finishes (logs always go to stderr)")
+	folder := flag.String("folder", "", "Read file names instead of IDs from stdin, and download the files of those names in this folder")
+	onAmbiguous := flag.String("on-ambiguous", ambiguousError, "With --folder, what to do when several files have the name: error, or all to download every match")
+	minRequestInterval := flag.Duration("min-request-interval", 0, "Space out API requests across all downloads by at least this long, e.g. 50ms, to avoid bursts being rate limited (0 disables)")
+	noPrefetch := flag.Bool("no-prefetch", false, "Start downloading as input arrives, instead of reading all of it and fetching every file's metadata first (for streaming input)")
+	retryBudget := flag.Int("retry-budget", 0, "Retries allowed per minute across all files; once spent, errors fail without retrying until the budget refills (0 means no limit)")
+	catalogPath := flag.String("catalog", "", "Write a CSV catalog of every file, with its Drive ID, name, local path, size, md5, MIME type, owner, modified time and status, to this file")
+	spaces := flag.String("spaces", "", "Comma separated Drive spaces folder listings and --folder lookups search: drive, appDataFolder (asks for the drive.appdata scope, kept in a token of its own) or photos (default: drive)")
+	corpora := flag.String("corpora", "", "Collections folder listings and --folder lookups search: user, domain, allDrives, or drive with --drive-id; shared drive items are always included")
+	driveID := flag.String("drive-id", "", "The shared drive to search with --corpora=drive")
+	indexDB := flag.String("index-db", "", "Record every downloaded file's ID, name, path, size, md5 and times in this SQLite database, updating it on later runs")
+	linkedFiles := flag.Bool("linked-files", false, "Also download the Drive files a Google Doc links to, into a <name>_files folder next to it (links in the document body only, one level deep)")
+	verifyMD5 := flag.Bool("verify", false, "Check each download against Drive's md5 checksum, deleting it and failing on a mismatch")
+	retryOnMismatch := flag.Bool("retry-on-checksum-mismatch", false, "With --verify or --cas-store, download a file again on a checksum mismatch, up to --max-retries times (at least once)")
+	inputJSON := flag.String("input-json", "", "Read the input from this JSON file instead of stdin: an array of {\"id\", \"output\", \"export\", \"download_as\", \"skip\"} objects overriding the output path, export format (pdf, docx, ... or a MIME type) and download type (see --download-as) per file")
+	sheetsPerTab := flag.Bool("sheets-per-tab", false, "Export every tab of a Google Sheet to <name>/<tab>.csv instead of one workbook (needs the Sheets API enabled for your OAuth client)")
+	pathCase := flag.String("case", "preserve", "Case of output paths: preserve, or lower to lowercase every folder and file name (names that then collide follow --collision)")
+	maxOpenFiles := flag.Uint64("max-open-files", 0, "Lower --concurrency so that downloads, at an output file and a connection each, and metadata lookups fit in this many open files (default: the ulimit -n)")
+	timeoutTotal := flag.Duration("timeout-total", 0, "Cancel everything, downloads in flight included, once the whole run has taken this long, and exit with status 4 (0 disables)")
+	copyOnQuota := flag.Bool("copy-on-quota-block", false, "When a file's download quota is exhausted, copy it to My Drive, download the copy and delete it (requires full Drive access, and room for the copy)")
+	keepQuotaCopy := flag.Bool("keep-quota-copies", false, "With --copy-on-quota-block, leave the copies in My Drive")
+	bytesFormat := flag.String("bytes-format", "", "How byte counts are shown: human (e.g. 1.5 GiB) or raw exact counts (default: human in logs, raw in the --catalog size column; JSON is always raw)")
+	whoamiOnly := flag.Bool("whoami", false, "Print the account the token is for, its scopes and storage use, and exit without reading any input")
+	maxFiles := flag.Int64("max-files", 0, "Download at most this many files, counted after --only-ids and --exclude-ids, with folders listed by name, or by --order-by, so the same ones are picked each time (0 means no limit)")
+	orderBy := flag.String("order-by", "", "Download files in this order instead of the input's: size-asc, size-desc, name or modified (oldest first); folder listings are sorted the same way, but streamed input with --no-prefetch or --folder keeps its order")
+	mimeRoutes := flag.String("mime-route", "", "Put files under a directory by MIME type, ahead of their folder path, e.g. 'image/*=images,video/*=videos,*=other' (first match wins, unmatched files stay in place; explicit output paths are never routed, and --exports-dir wins for exports)")
+	dumpTree := flag.String("dump-tree", "", "With --recursive, write the folders walked, with the ID, name, MIME type and size of everything in them, as a nested JSON tree to this file")
+	smallThreshold := flag.String("small-file-threshold", "", "Reserve --small-file-slots of the --concurrency download slots for files smaller than this, e.g. 1M, so they do not wait behind large transfers")
+	smallSlots := flag.Int("small-file-slots", 2, "With --small-file-threshold, how many download slots only small files may use")
+	onEmptyInput := flag.String("on-empty-input", onEmptyWarn, "What to do when the input holds no file IDs at all: warn, or error to also exit with status 1")
+	sinkURL := flag.String("sink", "", "Stream downloads to this storage instead of the current directory: gs://bucket/prefix for Cloud Storage (with the application default credentials) or file://dir")
+	keepPartial := flag.Bool("keep-partial", false, "Keep failed or interrupted downloads as <name>.partial, with a .partial.json sidecar of the file's md5 and modified time, and resume them on the next run if the file is unchanged on Drive (exports and --gzip/--gunzip always start over)")
+	perDrive := flag.Int("concurrency-per-drive", 0, "Download at most this many files of any one shared drive at the same time, within --concurrency; files in My Drive count as one drive (0 means no limit)")
+	verifyAgainst := flag.String("verify-against", "", "Check every download against this md5sum-style manifest of \"<md5>  <relative path>\" lines, failing files that do not match, and log how many matched, mismatched or were not listed")
+	listDrivesOnly := flag.Bool("list-drives", false, "Print the ID and name of every shared drive you can access, as text or --output-format=ndjson, and exit without reading any input")
+	onEmptyFile := flag.String("on-empty-file", onEmptyDownload, "What to do with files that are empty on Drive: download them, skip them, or warn and download them")
+	retryOnStatusCodes := flag.String("retry-on-status", "", "Also retry API errors with these HTTP status codes, e.g. 408,403, on top of rate limits, 5xx errors and files still being processed")
+	revisions := flag.Int("revisions", 0, "Also save up to this many of the revisions before each file's current content, as <name>.rev<time><ext> next to it, named after when each was made (Google Docs, Sheets and Slides are left out)")
+	waitAvailable := flag.Duration("wait-for-availability", 0, "Keep retrying files that are not found or not accessible for up to this long, e.g. 2m, for shares that have not propagated yet (0 fails them right away)")
+	markdownImages := flag.Bool("markdown-images", false, "With --export-format document=md, move the images Drive embeds in the Markdown into a <name>_images folder next to it and link to them there")
+	retryLogPath := flag.String("retry-log", "", "Append a JSON line to this file for every retry, with the file ID, attempt, cause (rate_limit, server_error, pending, transfer or other), error and backoff delay")
+	mirrorID := flag.String("mirror", "", "Keep the output tree an exact copy of this folder: downloads it recursively, skips files whose md5 (or, for Google Docs, modification time) is unchanged, downloads changed ones again and deletes local files it no longer has; stdin is not read (preview with --dry-run)")
+	downloadAs := flag.String("download-as", "", "Treat the files given as input as this MIME type, e.g. application/pdf for one Drive reports as application/octet-stream: they are named with its extension and routed by it; the content is saved as is, not converted (an --input-json entry can set \"download_as\" instead)")
+	acknowledgeAbuse := flag.Bool("acknowledge-abuse", false, "Download files Drive flags as malware or spam instead of failing them; only for files you own or manage, and at your own risk")
+	fileMode := flag.String("file-mode", "0666", "Permission bits in octal that downloaded files are created with; the umask still applies (with the usual 022, 0666 gives 0644), unlike --chmod, which sets exact bits afterwards")
+	dirMode := flag.String("dir-mode", "0755", "Permission bits in octal that output folders are created with, e.g. 0750; the umask still applies, and folders that already exist are left alone")
+	streamHash := flag.String("stream-hash", "", "Compute these checksums of each download as it is written, md5, sha256 or both comma separated; they are logged with --progress-interval lines and once the file is complete, with no second read of the file")
+	onDiskErr := flag.String("on-disk-error", onDiskErrorSkip, "What to do when writing a file to disk fails (a full disk, a read-only mount, missing permissions): skip (fail that file and go on) or abort (stop the run gracefully and exit with status 5); Drive errors still only fail their file")
+	cleanPartials := flag.Bool("clean-partials", false, "With --keep-partial, remove the partial downloads under the output and staging folders that belong to none of this run's files, instead of only listing them")
+	modifiedAfter := flag.String("modified-after", "", "Only download files modified after this date or time, e.g. 2024-05-01 or 2024-05-01T12:00:00Z; folders are still walked")
+	sinceLastRun := flag.String("since-last-run", "", "Only download files modified since the start of the last successful run recorded in this file, and record this run in it if it succeeds; the first run downloads everything")
+	updateSinceAlways := flag.Bool("update-since-always", false, "With --since-last-run, record the run even when it was incomplete or had failures")
+	maxAPICalls := flag.Int64("max-api-calls", 0, "Stop starting new work once this many Drive API requests were made, and refuse any past it, to bound quota usage (0 means no limit; the summary reports the count either way)")
+	dirTemplate := flag.String("dir-template", "", "Output folder of each file as a Go template, e.g. '{{.Owner}}/{{.ModifiedYear}}', instead of its Drive folders; fields: ID, Name, Base, Ext, MimeType, Path (the Drive folder path), Owner, ModifiedYear, ModifiedMonth, ModifiedDay, CreatedYear")
+	nameTemplate := flag.String("name-template", "", "Output file name as a Go template with the fields of --dir-template, e.g. '{{.Base}}-{{.ID}}{{.Ext}}', instead of the Drive name; slashes in it are replaced")
+	xattrID := flag.Bool("xattr-id", false, "Store each downloaded file's Drive ID in its user.gdrive.id extended attribute (Linux and macOS; skipped with a warning where unsupported); with --verify-only, files missing from their path are then looked up by it")
+	parallelParts := flag.Int("parallel-file-parts", 1, "Download each file of at least --parallel-file-min-size in this many byte ranges at once, written in place and checked against Drive's md5 at the end, for links where one stream is slow (1 means one stream; not used for exports, --gzip/--gunzip, --keep-partial, --copy-on-quota-block or --sink)")
+	parallelMinSize := flag.String("parallel-file-min-size", defaultPartsMinSize, "With --parallel-file-parts, the smallest file to split, e.g. 500M")
+	progressLogPath := flag.String("progress-log", "", "Append a JSON line to this file as each download is written, with the file ID, bytes written so far and size, at most once a second per file and once it is complete")
+	var exportAs stringList
+	flag.Var(&exportAs, "export-format", "Export a native type as this MIME type or extension instead of the default, e.g. document=application/pdf or document=md (Markdown; comments, drawings and page layout are lost); formats Files.Export refuses are fetched through the file's export links (repeatable)")
+	flag.Var(&includeFields, "include-field", "Extra Drive file field to fetch, e.g. description or imageMediaMetadata(width,height); saved with the file's metadata in <name>.metadata.json (repeatable)")
+	flag.Usage = usage
+	flag.Parse()
+
+	if *logFile != "" {
+		lf, err := openRotatingFile(*logFile, *logFileMaxSize<<20)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer lf.Close()
+		log.SetOutput(io.MultiWriter(os.Stderr, lf))
+	}
 
-	home, err := os.UserHomeDir()
+	if *mirrorID != "" {
+		if *flatten || *noPath || *statePath != "" || *onlyIDs != "" || *excludeIDs != "" || *folder != "" || *inputJSON != "" || *sinkURL != "" {
+			log.Fatal("--mirror cannot be used with --flatten, --no-path, --state, --only-ids, --exclude-ids, --folder, --input-json or --sink")
+		}
+		*recursive, *skipExisting, *deleteExtraneous = true, true, true
+		*skipMatch = skipMatchChecksum
+	}
+
+	normalize, err := parseNormalization(*normalization)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if normalize, err = withCase(normalize, *pathCase); err != nil {
+		log.Fatal(err)
+	}
+	if *bufferSize <= 0 {
+		log.Fatal("--buffer-size must be positive")
+	}
+	if *dryRun && (*resolveOnly || *verifyOnly || *casDir != "") {
+		log.Fatal("--dry-run cannot be used with --resolve-only, --verify-only or --cas-store")
+	}
+	if *retryOnMismatch && !*verifyMD5 && *casDir == "" {
+		log.Fatal("--retry-on-checksum-mismatch requires --verify or --cas-store")
+	}
+	if *sheetsPerTab && *casDir != "" {
+		log.Fatal("--sheets-per-tab cannot be used with --cas-store")
+	}
+	if *repair && !*verifyOnly {
+		log.Fatal("--repair requires --verify-only")
+	}
+	if *statePath != "" && !*recursive {
+		log.Fatal("--state requires --recursive")
+	}
+	if *grace != 0 && *maxRuntime == 0 {
+		log.Fatal("--grace requires --max-runtime")
+	}
+	if err := setBytesFormat(*bytesFormat); err != nil {
+		log.Fatal(err)
+	}
+	var routes []mimeRoute
+	if *mimeRoutes != "" {
+		if routes, err = parseMimeRoutes(*mimeRoutes); err != nil {
+			log.Fatal(err)
+		}
+	}
+	onEmpty, err := parseOnEmptyInput(*onEmptyInput)
+	if err != nil {
+		log.Fatal(err)
+	}
+	emptyFiles, err := parseOnEmptyFile(*onEmptyFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	order, err := parseOrderBy(*orderBy)
 	if err != nil {
-		log.Fatalf("Unable to get home directory: %v", err)
+		log.Fatal(err)
+	}
+	if order != nil && (*noPrefetch || *folder != "") {
+		log.Print("Warning: --order-by cannot sort streamed input, only folder listings are sorted")
+	}
+	if *sinkURL != "" && (*stagingDir != "" || *casDir != "" || *chmod != "" || *readonlyIfView || *verifyOnly || *dryRun ||
+		*deleteExtraneous || *sheetsPerTab || *withComments || len(includeFields) > 0 || *linkedFiles || *minFreeSpace != "0") {
+		log.Fatal("--sink cannot be used with --staging-dir, --cas-store, --chmod, --readonly-if-view, --verify-only, --dry-run, --delete-extraneous, --sheets-per-tab, --export-comments, --include-field, --linked-files or --min-free-space, which work on local files")
+	}
+	var manifest *checksumManifest
+	if *verifyAgainst != "" {
+		if *sinkURL != "" {
+			log.Fatal("--verify-against cannot be used with --sink, the downloads are not on local disk")
+		}
+		if manifest, err = loadManifest(*verifyAgainst); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *dumpTree != "" && !*recursive {
+		log.Fatal("--dump-tree requires --recursive")
+	}
+	if *maxFiles < 0 {
+		log.Fatal("--max-files cannot be negative")
+	}
+	if *revisions < 0 {
+		log.Fatal("--revisions cannot be negative")
+	}
+	if *revisions > 0 && (*sinkURL != "" || *casDir != "") {
+		log.Fatal("--revisions cannot be used with --sink or --cas-store")
+	}
+	if *markdownImages && (*sinkURL != "" || *casDir != "" || *gzipFiles) {
+		log.Fatal("--markdown-images cannot be used with --sink, --cas-store or --gzip")
+	}
+	if *maxAPICalls < 0 {
+		log.Fatal("--max-api-calls cannot be negative")
+	}
+	if *perDrive < 0 {
+		log.Fatal("--concurrency-per-drive cannot be negative")
+	}
+	if *keepQuotaCopy && !*copyOnQuota {
+		log.Fatal("--keep-quota-copies requires --copy-on-quota-block")
+	}
+	if *cleanPartials && !*keepPartial {
+		log.Fatal("--clean-partials requires --keep-partial")
+	}
+	if *concurrency <= 0 || *metadataConcurrency <= 0 {
+		log.Fatal("--concurrency and --metadata-concurrency must be positive")
+	}
+	if fit, err := fitConcurrency(*concurrency, *metadataConcurrency, *maxOpenFiles); err != nil {
+		log.Fatal(err)
+	} else if fit < *concurrency {
+		log.Printf("Lowering --concurrency from %d to %d to stay within the open files limit", *concurrency, fit)
+		*concurrency = fit
+	}
+	var smallSize int64
+	if *smallThreshold != "" {
+		if smallSize, err = parseSize(*smallThreshold); err != nil {
+			log.Fatalf("Invalid --small-file-threshold: %v", err)
+		}
+		if *smallSlots <= 0 || *smallSlots >= *concurrency {
+			log.Fatalf("--small-file-slots must be positive and less than --concurrency (%d)", *concurrency)
+		}
+	}
+	match, err := parseSkipMatch(*skipMatch)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if match == skipMatchChecksum && *sinkURL != "" {
+		log.Fatal("--skip-match=checksum cannot be used with --sink")
+	}
+	dirConflict, err := parseDirConflict(*onDirConflict)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := validateFields(includeFields); err != nil {
+		log.Fatalf("Invalid --include-field: %v", err)
+	}
+	exportOverrides, err := parseExportFormats(exportAs)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *gunzip && *gzipFiles {
+		log.Fatal("--gunzip and --gzip cannot be used together")
+	}
+	if (*gunzip || *gzipFiles) && (*casDir != "" || *verifyOnly || *verifyMD5) {
+		// These compare local bytes with Drive's md5.
+		log.Fatal("--gunzip and --gzip cannot be used with --cas-store, --verify-only or --verify")
+	}
+	stdout, err := newLineWriter(os.Stdout, *outputFormat)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ambiguous, err := parseOnAmbiguous(*onAmbiguous)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *folder != "" && *statePath != "" {
+		// A resumed traversal submits folder IDs, which would be taken for names.
+		log.Fatal("--folder cannot be used with --state")
+	}
+	mode, err := parseMode("chmod", *chmod)
+	if err != nil {
+		log.Fatal(err)
+	}
+	newFileMode, err := parseMode("file-mode", *fileMode)
+	if err != nil {
+		log.Fatal(err)
+	}
+	newDirMode, err := parseDirMode(*dirMode)
+	if err != nil {
+		log.Fatal(err)
+	}
+	diskErrors, err := parseOnDiskError(*onDiskErr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	retry := retrier{maxRetries: *maxRetries}
+	if *retryBudget > 0 {
+		retry.budget = newRetryBudget(*retryBudget)
+	}
+	if *retryOnStatusCodes != "" {
+		codes, err := parseStatusCodes(*retryOnStatusCodes)
+		if err != nil {
+			log.Fatal(err)
+		}
+		retry.retryable = retryOnStatus(codes)
+	}
+	if *retryLogPath != "" {
+		rl, err := openRetryLog(*retryLogPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer rl.Close()
+		retry.log = rl
+	}
+	scopeOfList, err := parseListScope(*spaces, *corpora, *driveID)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var jsonEntries []inputEntry
+	var exportByID map[string]exportFormat
+	var downloadAsByID map[string]string
+	if *inputJSON != "" {
+		if jsonEntries, exportByID, downloadAsByID, err = loadInputJSON(*inputJSON); err != nil {
+			log.Fatal(err)
+		}
+	}
+	exportOpts, err := parseExportOptions(exportOptions)
+	if err != nil {
+		log.Fatal(err)
+	}
+	filter, err := newIDFilter(*onlyIDs, *excludeIDs)
+	if err != nil {
+		log.Fatal(err)
+	}
+	coll, err := newCollisions(*collision)
+	if err != nil {
+		log.Fatal(err)
+	}
+	minFree, err := parseSize(*minFreeSpace)
+	if err != nil {
+		log.Fatalf("Invalid --min-free-space: %v", err)
+	}
+	if *trashAfter && *collision == collisionOverwrite {
+		// Two files written to one path would both be trashed, with only
+		// the last of them kept locally.
+		log.Fatal("--trash-after-download requires --collision=rename or --collision=hash")
+	}
+	if *trashAfter && !*yes {
+		if err := confirmTrash(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	var cas *casStore
+	if *casDir != "" {
+		if cas, err = openCASStore(*casDir, newFileMode, newDirMode); err != nil {
+			log.Fatal(err)
+		}
+		defer cas.Close()
+	}
+	var idx *index
+	if *indexDB != "" {
+		if idx, err = openIndex(*indexDB); err != nil {
+			log.Fatal(err)
+		}
+		defer idx.Close()
 	}
-	b, err := os.ReadFile(fmt.Sprintf("%s/.credentials.json", home))
+	if *stagingDir != "" {
+		if err := prepareStagingDir(*stagingDir, "."); err != nil {
+			log.Fatal(err)
+		}
+	}
+	disk := newDiskGuard(minFree, *minFreeTimeout, ".", *stagingDir, *exportsDir, *casDir)
+
+	// --timeout-total bounds the run as a whole: it cancels the root
+	// context, which nothing outlives, whatever --grace says.
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if *timeoutTotal > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), *timeoutTotal)
+		stop := context.AfterFunc(ctx, func() {
+			if ctx.Err() == context.DeadlineExceeded {
+				log.Printf("Total timeout of %v reached, cancelling everything", *timeoutTotal)
+			}
+		})
+		defer stop()
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+	defer cancel()
+	// Past --max-runtime or --max-api-calls nothing new is started.
+	start, stopStarting := context.WithCancel(ctx)
+	defer stopStarting()
+
+	b, err := loadCredentials()
 	if err != nil {
-		log.Fatalf("Unable to read client secret file: %v", err)
+		log.Fatal(err)
 	}
 
-	config, err := google.ConfigFromJSON(b, driveMetadataScope)
+	// The token file stores the user's access and refresh tokens. Write
+	// and app data access are kept in tokens of their own so that a
+	// read-only token is never silently upgraded.
+	scopes, tokFile := []string{driveMetadataScope}, "token"
+	if *trashAfter || *copyOnQuota {
+		scopes, tokFile = []string{driveWriteScope}, "token-write"
+	}
+	if scopeOfList.appData() {
+		scopes, tokFile = append(scopes, driveAppDataScope), tokFile+"-appdata"
+	}
+	tokFile += ".json"
+	config, err := google.ConfigFromJSON(b, scopes...)
 	if err != nil {
 		log.Fatalf("Unable to parse client secret file to config: %v", err)
 	}
 
-	client := getClient(config)
-	driveService, err := drive.NewService(ctx, option.WithHTTPClient(client))
+	client := getClient(config, tokFile)
+	var tokenExpired atomic.Bool
+	client.Transport = &tokenWatchTransport{base: client.Transport, expired: func() {
+		log.Print("The token has expired or was revoked during the run, authorize gdrive-dl again")
+		if _, ok := os.LookupEnv(tokenEnv); !ok {
+			backupToken(tokFile)
+		}
+		tokenExpired.Store(true)
+		cancel()
+	}}
+	if *minRequestInterval > 0 {
+		client.Transport = &pacingTransport{interval: *minRequestInterval, base: client.Transport}
+	}
+	runStats := newStats()
+	calls := &callCountTransport{base: client.Transport, calls: &runStats.apiCalls, limit: *maxAPICalls, reached: func() {
+		log.Printf("Reached --max-api-calls of %d, not starting new work", *maxAPICalls)
+		stopStarting()
+	}}
+	client.Transport = calls
+	driveService, err := newDriveService(ctx, client, *userAgent)
 	if err != nil {
 		log.Fatalf("Unable to retrieve Drive client: %v", err)
 	}
+	if *whoamiOnly {
+		if err := whoami(ctx, driveService, scopes, os.Stdout); err != nil {
+			if tokenExpired.Load() {
+				os.Exit(exitTokenExpired)
+			}
+			log.Fatal(err)
+		}
+		return
+	}
+	if *listDrivesOnly {
+		if err := listDrives(ctx, driveService, stdout); err != nil {
+			if tokenExpired.Load() {
+				os.Exit(exitTokenExpired)
+			}
+			log.Fatal(err)
+		}
+		return
+	}
+	var n namer = folderNamer{}
+	if *flatten {
+		n = flatNamer{}
+	}
+	if *dirTemplate != "" || *nameTemplate != "" {
+		if n, err = newTemplateNamer(*dirTemplate, *nameTemplate, *flatten); err != nil {
+			log.Fatal(err)
+		}
+	}
+	d := &downloader{
+		srv:            driveService,
+		client:         client,
+		parents:        newParentCache(driveService, retry),
+		exportComments: *withComments,
+		normalize:      normalize,
+		namer:          n,
+		noPath:         *noPath,
+		exportsDir:     *exportsDir,
+		strictSize:     *strictSize,
+		trashAfter:     *trashAfter,
+		collisions:     coll,
+		organizeShared: *organizeShared,
+		templated:      *dirTemplate != "" || *nameTemplate != "",
+		skipExisting:   *skipExisting,
+		skipMatch:      match,
+		stagingDir:     *stagingDir,
+		stats:          runStats,
+		onDirConflict:  dirConflict,
+		extraFields:    includeFields,
+		verifyOnly:     *verifyOnly,
+		dryRun:         *dryRun,
+		cas:            cas,
+		retry:          retry,
+		buffers:        newBufferPool(*bufferSize),
+		exportAs:       exportOverrides,
+		exportOptions:  exportOpts,
+		exportByID:     exportByID,
+		catalog:        *catalogPath != "",
+		listScope:      scopeOfList,
+		indexed:        idx != nil,
+		verifyMD5:      *verifyMD5,
+		retryMismatch:  *retryOnMismatch,
+		chmod:          mode,
+		newFileMode:    newFileMode,
+		dirMode:        newDirMode,
+		readonlyIfView: *readonlyIfView,
+		gunzip:         *gunzip,
+		gzip:           *gzipFiles,
+	}
+	d.keepPartial = *keepPartial
+	if *progressLogPath != "" {
+		pl, err := openProgressLog(*progressLogPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer pl.Close()
+		d.progress = pl.report
+	}
+	if *parallelParts < 1 {
+		log.Fatal("--parallel-file-parts must be positive")
+	}
+	d.parts = *parallelParts
+	if d.partsMinSize, err = parseSize(*parallelMinSize); err != nil {
+		log.Fatalf("Invalid --parallel-file-min-size: %v", err)
+	}
+	if d.modifiedAfter, err = parseModifiedAfter(*modifiedAfter); err != nil {
+		log.Fatal(err)
+	}
+	if *sinceLastRun != "" {
+		last, ok, err := loadLastRun(*sinceLastRun)
+		switch {
+		case err != nil:
+			log.Fatal(err)
+		case !ok:
+			log.Printf("No earlier run recorded in %s, downloading everything", *sinceLastRun)
+		default:
+			log.Printf("Downloading files modified since the last run, at %s", last.Format(time.RFC3339))
+			if last.After(d.modifiedAfter) {
+				d.modifiedAfter = last
+			}
+		}
+	}
+	if *keepPartial {
+		dirs := []string{"."}
+		if *stagingDir != "" && !filepath.IsLocal(*stagingDir) {
+			dirs = append(dirs, *stagingDir)
+		}
+		if d.partials, err = findPartials(dirs...); err != nil {
+			log.Fatal(err)
+		}
+		if n := d.partials.count(); n > 0 {
+			log.Printf("Found %d partial downloads left by an earlier run, resuming them as their files come up", n)
+		}
+	}
+	d.onEmptyFile = emptyFiles
+	d.waitAvailable = *waitAvailable
+	d.driveIDs = *perDrive > 0
+	d.mimeRoutes = routes
+	d.downloadAsByID = downloadAsByID
+	d.acknowledgeAbuse = *acknowledgeAbuse
+	if d.streamHashes, err = parseStreamHashes(*streamHash); err != nil {
+		log.Fatal(err)
+	}
+	if *downloadAs != "" {
+		if d.downloadAs, err = parseDownloadAs(*downloadAs); err != nil {
+			log.Fatal(err)
+		}
+	}
+	switch {
+	case order != nil:
+		d.orderBy = order.listing
+	case *maxFiles > 0:
+		d.orderBy = "name"
+	}
+	if *copyOnQuota {
+		d.quotaCopies = newQuotaCopies(*keepQuotaCopy)
+	}
+
+	if *sinkURL != "" {
+		if d.sink, err = openSink(ctx, *sinkURL, d.newFileMode, d.dirMode); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *sheetsPerTab {
+		if d.sheets, err = sheets.NewService(ctx, option.WithHTTPClient(client)); err != nil {
+			log.Fatalf("Unable to retrieve Sheets client: %v", err)
+		}
+	}
+
+	if *statusAddr != "" {
+		d.stats.serveStatus(*statusAddr)
+	}
+	if *progressInterval > 0 {
+		go d.stats.logProgress(ctx, *progressInterval)
+	}
 
 	sigChan := make(chan os.Signal, 1)
 
@@ -135,57 +774,247 @@ func main() {
 		log.Print("The application doesn't terminate with Ctrl+C, use Ctrl+D instead")
 	}()
 
-	scanner := bufio.NewScanner(os.Stdin)
-	sem := semaphore.NewWeighted(int64(10))
-	var wg sync.WaitGroup
-	for scanner.Scan() {
-		wg.Add(1)
-		fileID := scanner.Text()
-		go func(fileID string) {
-			defer wg.Done()
-			if fileID == "" {
-				return
+	// Input is read on its own goroutine so that a fail-fast abort does not
+	// have to wait for the next line on stdin.
+	entries := make(chan inputEntry)
+	var inputFailed atomic.Bool
+	go func() {
+		defer close(entries)
+		if *mirrorID != "" {
+			entries <- inputEntry{id: *mirrorID}
+			return
+		}
+		if *inputJSON != "" {
+			for _, entry := range jsonEntries {
+				entries <- entry
+			}
+			return
+		}
+		scanner := bufio.NewScanner(os.Stdin)
+		scanner.Buffer(make([]byte, 0, min(64*1024, *maxLineSize)), *maxLineSize)
+		if *stdinNull {
+			scanner.Split(scanNUL)
+		}
+		for scanner.Scan() {
+			entries <- parseEntry(scanner.Text())
+		}
+		if err := scanner.Err(); err != nil {
+			if err == bufio.ErrTooLong {
+				err = fmt.Errorf("an entry is longer than %d bytes, raise --max-line-size", *maxLineSize)
 			}
+			log.Printf("Unable to read the whole input, the remaining entries were not processed: %v", err)
+			inputFailed.Store(true)
+		}
+	}()
 
-			sem.Acquire(ctx, 1)
-			defer sem.Release(1)
+	p := &pipeline{
+		d:           d,
+		disk:        disk,
+		stdout:      stdout,
+		resolveOnly: *resolveOnly,
+		dryRun:      *dryRun,
+		verifyOnly:  *verifyOnly,
+		repair:      *repair,
+		filter:      filter,
+		failFast:    *failFast,
+		onDiskError: diskErrors,
+		maxAPICalls: *maxAPICalls,
+		cancel:      cancel,
+		metaSem:     semaphore.NewWeighted(int64(*metadataConcurrency)),
+		sem:         semaphore.NewWeighted(int64(*concurrency)),
+	}
+	if smallSize > 0 {
+		p.sem = semaphore.NewWeighted(int64(*concurrency - *smallSlots))
+		p.smallSem, p.smallSize = semaphore.NewWeighted(int64(*smallSlots)), smallSize
+	}
+	if *perDrive > 0 {
+		p.perDrive = newDriveSlots(*perDrive)
+	}
+	if *reportPath != "" || *catalogPath != "" {
+		p.report = &report{}
+	}
+	p.index = idx
+	p.maxFiles = *maxFiles
+	p.order = order
+	p.manifest = manifest
+	p.linkedFiles = *linkedFiles
+	p.revisions = *revisions
+	p.markdownImages = *markdownImages
+	if *xattrID {
+		p.xattrIDs = &xattrIDs{roots: d.outputRoots()}
+	}
+	if *folder != "" {
+		p.names = &nameLookup{folder: *folder, onAmbiguous: ambiguous}
+	}
+	// Local files missing from the source can only be told apart when each
+	// input folder is listed whole in this run, into a directory of its own.
+	canMirror := *recursive && !*flatten && !*noPath && *statePath == "" && !filter.active()
+	if *deleteExtraneous && !canMirror {
+		log.Fatal("--delete-extraneous requires --recursive, and cannot be used with --flatten, --no-path, --state, --only-ids or --exclude-ids")
+	}
+	if (*dryRun || *deleteExtraneous) && canMirror {
+		p.mirror = newMirror()
+		d.mirror = p.mirror
+	}
+	if *dumpTree != "" {
+		p.tree = newFolderTree()
+	}
 
-			file, err := driveService.Files.Get(fileID).Fields("name,parents").Do()
-			if err != nil {
-				log.Printf("Unable to retrieve file: %v", err)
-				return
-			}
-			p, err := getFolderPath(driveService, file)
-			if err != nil {
-				log.Printf("Unable to retrieve folder path: %v", err)
-				return
+	// Once the --max-runtime grace period is over too, the downloads still
+	// running are cancelled.
+	p.start, p.stopStarting = start, stopStarting
+	if *maxRuntime > 0 {
+		deadline := time.AfterFunc(*maxRuntime, func() {
+			log.Printf("Maximum runtime of %v reached, not starting new downloads", *maxRuntime)
+			stopStarting()
+			if *grace > 0 {
+				time.AfterFunc(*grace, func() {
+					log.Printf("Grace period of %v is over, cancelling the downloads in flight", *grace)
+					cancel()
+				})
 			}
-			resp, err := driveService.Files.Get(fileID).Download()
-			if err != nil {
-				log.Printf("Unable to download file: %v", err)
-				return
+		})
+		defer deadline.Stop()
+	}
+	// An input without entries is only expected when resuming a traversal.
+	var given, resumed int
+	if *recursive {
+		if p.walker, err = newWalker(p, *statePath); err != nil {
+			log.Fatal(err)
+		}
+		resumed = p.walker.resume(ctx)
+	}
+	// The pre-flight needs the whole input, and names given with --folder
+	// are looked up as they are processed instead.
+	prefetch := !*noPrefetch && *folder == ""
+	var pending []inputEntry
+loop:
+	for {
+		var entry inputEntry
+		var ok bool
+		select {
+		case <-start.Done():
+			break loop
+		case entry, ok = <-entries:
+			if !ok {
+				break loop
 			}
-			defer resp.Body.Close()
+		}
+		if entry.id == "" {
+			continue
+		}
+		given++
+		if prefetch {
+			pending = append(pending, entry)
+			continue
+		}
+		p.submit(ctx, entry, nil)
+	}
+	emptyInput := given == 0 && resumed == 0 && start.Err() == nil && !inputFailed.Load()
+	if emptyInput {
+		log.Print("No file IDs provided: the input was empty")
+	}
+	if prefetch && start.Err() == nil {
+		for _, entry := range p.prefetch(ctx, pending) {
+			p.submit(ctx, entry, nil)
+		}
+	}
+	p.wait(ctx)
+	if p.walker != nil {
+		p.walker.close()
+		if start.Err() == nil {
+			p.walker.complete()
+		}
+	}
+	switch {
+	case p.mirror == nil:
+	case start.Err() != nil || p.incomplete.Load() || d.stats.failed.Load() > 0:
+		log.Print("Not looking for extraneous local files, the source was not listed completely")
+	case *dryRun:
+		paths, err := p.mirror.extraneous()
+		if err != nil {
+			log.Print(err)
+		}
+		for _, path := range paths {
+			p.stdout.printf("%s\t-\t%s", planDelete, path)
+			p.stdout.record(&result{Path: path, Status: statusPlanned, Outcome: planDelete})
+		}
+	case *deleteExtraneous:
+		n, err := p.mirror.deleteExtraneous()
+		if err != nil {
+			log.Print(err)
+		}
+		log.Printf("Deleted %d extraneous files", n)
+	}
+	if d.partials != nil {
+		// Files the run did not get to may still have their partials.
+		if start.Err() == nil && !inputFailed.Load() && !p.incomplete.Load() && !p.full() {
+			d.partials.reportOrphans(*cleanPartials)
+		} else if *cleanPartials {
+			log.Print("Not cleaning partial downloads, the run did not get to every file")
+		}
+	}
+	filter.logSummary()
+	if *dryRun {
+		p.logCallEstimate()
+	}
+	if *verifyOnly {
+		p.verified.logSummary()
+	}
+	if manifest != nil {
+		manifest.logSummary()
+	}
+	if !*resolveOnly && !*dryRun && (!*verifyOnly || *repair) {
+		d.stats.logSummary()
+	}
 
-			if p == "" {
-				p = "./"
-			}
-			if err = os.MkdirAll(p, 0755); err != nil {
-				log.Printf("Unable to create destination folder: %s\n", p)
-				return
-			}
-			outFile, err := os.Create(fmt.Sprintf("%s%s", p, file.Name))
-			if err != nil {
-				log.Printf("Unable to create download file")
-				return
-			}
-			defer outFile.Close()
-			_, err = io.Copy(outFile, resp.Body)
-			if err != nil {
-				log.Printf("Unable to write file content: %v", err)
-				return
+	if *reportPath != "" {
+		// Anything left unread on stdin was not started either.
+		complete := start.Err() == nil && !inputFailed.Load() && !p.incomplete.Load() && d.stats.failed.Load() == 0
+		if err := p.report.write(*reportPath, d.stats, complete); err != nil {
+			log.Print(err)
+		}
+	}
+	if p.tree != nil {
+		// A failure may be a folder that could not be listed.
+		complete := start.Err() == nil && !inputFailed.Load() && !p.incomplete.Load() && d.stats.failed.Load() == 0 && !p.full()
+		if err := p.tree.write(*dumpTree, newFileMode, complete); err != nil {
+			log.Print(err)
+		}
+	}
+	if *catalogPath != "" {
+		if err := p.report.writeCatalog(*catalogPath); err != nil {
+			log.Print(err)
+		}
+	}
+
+	if *sinceLastRun != "" && !*dryRun {
+		succeeded := ctx.Err() == nil && start.Err() == nil && !inputFailed.Load() && !p.incomplete.Load() && d.stats.failed.Load() == 0 && !p.full()
+		switch {
+		case succeeded || *updateSinceAlways:
+			if err := saveLastRun(*sinceLastRun, runStarted); err != nil {
+				log.Print(err)
 			}
-		}(fileID)
+		default:
+			log.Printf("Not recording this run in %s, it was incomplete or had failures", *sinceLastRun)
+		}
+	}
+
+	if ctx.Err() == context.DeadlineExceeded {
+		os.Exit(exitDeadline)
+	}
+	if tokenExpired.Load() {
+		os.Exit(exitTokenExpired)
+	}
+	if p.diskFailed.Load() {
+		log.Print("Aborted after a write to the local filesystem failed (--on-disk-error=abort)")
+		os.Exit(exitDiskError)
+	}
+	if p.failed.Load() {
+		log.Print("Aborted after the first failed download (--fail-fast)")
+		os.Exit(1)
+	}
+	if inputFailed.Load() || (emptyInput && onEmpty == onEmptyError) {
+		os.Exit(1)
 	}
-	wg.Wait()
 }
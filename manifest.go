@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// checksumManifest is an external md5sum-style manifest the downloads are
+// checked against with --verify-against, independently of Drive's own
+// checksums.
+type checksumManifest struct {
+	sums map[string]string // md5 by slash separated relative path
+
+	mu         sync.Mutex
+	seen       map[string]bool
+	matched    int
+	mismatched int
+	unlisted   int
+}
+
+// loadManifest reads "<md5>  <path>" lines, as written by md5sum; the
+// binary mode marker "*" before the path is accepted too.
+func loadManifest(path string) (*checksumManifest, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open checksum manifest: %v", err)
+	}
+	defer f.Close()
+	m := &checksumManifest{sums: map[string]string{}, seen: map[string]bool{}}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		sum, name, ok := strings.Cut(line, " ")
+		name = strings.TrimPrefix(strings.TrimPrefix(name, " "), "*")
+		if !ok || len(sum) != 32 || name == "" {
+			return nil, fmt.Errorf("%s:%d: expected \"<md5>  <path>\"", path, n)
+		}
+		m.sums[manifestKey(name)] = strings.ToLower(sum)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("unable to read checksum manifest: %v", err)
+	}
+	return m, nil
+}
+
+func manifestKey(path string) string {
+	return filepath.ToSlash(filepath.Clean(strings.TrimPrefix(path, "./")))
+}
+
+// check hashes the file downloaded to local and compares it with the
+// manifest entry of its output path dest. Files the manifest does not list
+// are only counted.
+func (m *checksumManifest) check(dest, local string) error {
+	key := manifestKey(dest)
+	want, listed := m.sums[key]
+	var sum string
+	var err error
+	if listed {
+		if sum, err = fileMD5(local); err != nil {
+			return err
+		}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	switch {
+	case !listed:
+		m.unlisted++
+		log.Printf("Warning: %s is not listed in the checksum manifest", dest)
+	case sum != want:
+		m.seen[key] = true
+		m.mismatched++
+		return fmt.Errorf("md5 %s does not match %s from the checksum manifest", sum, want)
+	default:
+		m.seen[key] = true
+		m.matched++
+	}
+	return nil
+}
+
+// logSummary logs the outcome of the checks, and how many manifest entries
+// no download was checked against.
+func (m *checksumManifest) logSummary() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	log.Printf("Checksum manifest: %d matched, %d mismatched, %d not listed, %d listed but not downloaded",
+		m.matched, m.mismatched, m.unlisted, len(m.sums)-len(m.seen))
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// markdownMimeType is the export format of Google Docs as Markdown. Drive
+// converts Docs to it natively; headings, lists, tables, links and basic
+// emphasis carry over, while comments, suggestions, drawings, page layout
+// and colours do not, and equations come out as plain text.
+const markdownMimeType = "text/markdown"
+
+// dataURIPattern matches the images Drive's Markdown export embeds as
+// base64 data URIs, with or without the angle brackets of a reference
+// definition.
+var dataURIPattern = regexp.MustCompile(`<?data:(image/[a-zA-Z0-9.+-]+);base64,([A-Za-z0-9+/=]+)>?`)
+
+// extractMarkdownImages moves the images embedded in the Markdown file at
+// path into a <name>_images folder next to it, and points the links at the
+// extracted files instead, for --markdown-images. It returns the paths of
+// the images extracted.
+func (d *downloader) extractMarkdownImages(path string) ([]string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read Markdown export: %v", err)
+	}
+	dir := markdownImagesDir(path)
+	n := 0
+	var images []string
+	var writeErr error
+	out := dataURIPattern.ReplaceAllFunc(b, func(m []byte) []byte {
+		sub := dataURIPattern.FindSubmatch(m)
+		data, err := base64.StdEncoding.DecodeString(string(sub[2]))
+		if err != nil || writeErr != nil {
+			return m
+		}
+		if n == 0 {
+			if writeErr = os.MkdirAll(dir, d.dirMode); writeErr != nil {
+				return m
+			}
+		}
+		n++
+		name := fmt.Sprintf("image%d%s", n, extensionFor(string(sub[1])))
+		if writeErr = os.WriteFile(filepath.Join(dir, name), data, d.newFileMode); writeErr != nil {
+			return m
+		}
+		images = append(images, filepath.Join(dir, name))
+		return []byte("<" + filepath.Base(dir) + "/" + name + ">")
+	})
+	if writeErr != nil {
+		return nil, fmt.Errorf("unable to extract Markdown images: %v", writeErr)
+	}
+	if n == 0 {
+		return nil, nil
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to rewrite Markdown export: %v", err)
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, out, d.newFileMode); err != nil {
+		os.Remove(tmp)
+		return nil, fmt.Errorf("unable to rewrite Markdown export: %v", err)
+	}
+	// The rename replaces the file, so the --chmod or --readonly-if-view
+	// mode and the --xattr-id attribute it was given are carried over.
+	if err := os.Chmod(tmp, info.Mode().Perm()); err != nil {
+		os.Remove(tmp)
+		return nil, fmt.Errorf("unable to rewrite Markdown export: %v", err)
+	}
+	if id, ok := getXattr(path, xattrIDName); ok {
+		if err := setXattr(tmp, xattrIDName, id); err != nil {
+			os.Remove(tmp)
+			return nil, fmt.Errorf("unable to rewrite Markdown export: %v", err)
+		}
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return nil, fmt.Errorf("unable to rewrite Markdown export: %v", err)
+	}
+	return images, nil
+}
+
+// markdownImagesDir is the folder the images of the Markdown export at path
+// are extracted to.
+func markdownImagesDir(path string) string {
+	return strings.TrimSuffix(path, filepath.Ext(path)) + "_images"
+}
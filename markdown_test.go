@@ -0,0 +1,44 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMarkdownImagesKeepModeAndID(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "Notes.md")
+	md := "# Notes\n\n![](data:image/png;base64,iVBORw0KGgo=)\n"
+	if err := os.WriteFile(path, []byte(md), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(path, modeViewOnly); err != nil {
+		t.Fatal(err)
+	}
+	xattrs := true
+	if err := setXattr(path, xattrIDName, "doc"); errors.Is(err, errXattrUnsupported) {
+		xattrs = false
+	} else if err != nil {
+		t.Fatal(err)
+	}
+
+	d := &downloader{newFileMode: 0666, dirMode: 0755}
+	images, err := d.extractMarkdownImages(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 1 {
+		t.Fatalf("extracted %v, want one image", images)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := info.Mode().Perm(); got != modeViewOnly {
+		t.Errorf("rewritten export has mode %v, want %v", got, modeViewOnly)
+	}
+	if id, ok := getXattr(path, xattrIDName); xattrs && (!ok || id != "doc") {
+		t.Errorf("rewritten export has ID %q (%v), want doc", id, ok)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// mimeRoute sends the files whose MIME type matches pattern into dir, for
+// --mime-route. Patterns are path.Match patterns such as image/* or exact
+// types, and a lone * matches every file, as a default bucket.
+type mimeRoute struct {
+	pattern string
+	dir     string
+}
+
+// parseMimeRoutes parses a comma separated list of <pattern>=<dir>, e.g.
+// image/*=images,video/*=videos,*=other.
+func parseMimeRoutes(s string) ([]mimeRoute, error) {
+	var routes []mimeRoute
+	for _, v := range strings.Split(s, ",") {
+		pattern, dir, ok := strings.Cut(strings.TrimSpace(v), "=")
+		if !ok || pattern == "" || dir == "" {
+			return nil, fmt.Errorf("invalid --mime-route %q, expected <mime pattern>=<dir>", v)
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid --mime-route pattern %q: %v", pattern, err)
+		}
+		if !filepath.IsLocal(dir) {
+			return nil, fmt.Errorf("--mime-route directory %q must be relative and stay inside the output directory", dir)
+		}
+		routes = append(routes, mimeRoute{pattern, filepath.Clean(dir)})
+	}
+	return routes, nil
+}
+
+// routeDir returns the directory of the first route matching mimeType, or
+// "" when none does.
+func routeDir(routes []mimeRoute, mimeType string) string {
+	for _, r := range routes {
+		if ok, _ := path.Match(r.pattern, mimeType); ok || r.pattern == "*" {
+			return r.dir
+		}
+	}
+	return ""
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"google.golang.org/api/drive/v3"
+)
+
+// Actions of the --dry-run plan.
+const (
+	planAdd    = "add"
+	planUpdate = "update"
+	planKeep   = "keep"
+	planDelete = "delete"
+)
+
+// planAction works out what a run would do with a resolved file, from
+// the local copy at dest.
+func (d *downloader) planAction(file *drive.File, dest string) (string, error) {
+	outcome, err := verifyLocal(file, dest)
+	if err != nil {
+		return "", err
+	}
+	switch outcome {
+	case verifyMissing:
+		return planAdd, nil
+	case verifyOK:
+		return planKeep, nil
+	}
+	// Exports have nothing to compare with and are exported again, unless
+	// --skip-match=checksum finds them unchanged since.
+	if outcome == verifyUnchecked && d.skipMatch == skipMatchChecksum && d.alreadyPresent(file, dest) {
+		return planKeep, nil
+	}
+	return planUpdate, nil
+}
+
+// mirror tracks the local directories of the folders given as input and
+// the paths the run resolved and wrote under them, so that local files that
+// are no longer in the source can be found. The writers record every path
+// they write, wherever it ended up.
+type mirror struct {
+	mu    sync.Mutex
+	roots map[string]bool
+	keep  map[string]bool
+	// owners are the resolved outputs whose companions, written by an
+	// earlier run and not again by this one, also belong to the source:
+	// their sidecars and revisions, and the files in ownedDirs, their
+	// sheet tabs and Markdown images.
+	owners    map[string]bool
+	ownedDirs map[string]bool
+}
+
+func newMirror() *mirror {
+	return &mirror{roots: map[string]bool{}, keep: map[string]bool{}, owners: map[string]bool{}, ownedDirs: map[string]bool{}}
+}
+
+// addRoot records the local directory of an input folder.
+func (m *mirror) addRoot(dir string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.roots[filepath.Clean(dir)] = true
+}
+
+// keepPath records a path that is part of the source, as written. A nil
+// mirror records nothing.
+func (m *mirror) keepPath(path string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.keep[filepath.Clean(path)] = true
+}
+
+// keepOutputs records the resolved output dest of a file in the source,
+// with dirs, the folders named after it that hold its sheet tabs or
+// Markdown images.
+func (m *mirror) keepOutputs(dest string, dirs ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	dest = filepath.Clean(dest)
+	m.keep[dest] = true
+	m.owners[dest] = true
+	for _, dir := range dirs {
+		m.ownedDirs[filepath.Clean(dir)] = true
+	}
+}
+
+// kept reports whether path, or the output it is a companion of, is part
+// of the source.
+func (m *mirror) kept(path string) bool {
+	if m.keep[path] {
+		return true
+	}
+	for _, ext := range []string{metadataSidecarExt, commentsSidecarExt} {
+		if base, ok := strings.CutSuffix(path, ext); ok && m.owners[base] {
+			return true
+		}
+	}
+	if base, ok := revisionOf(path); ok && m.owners[base] {
+		return true
+	}
+	return m.ownedDirs[filepath.Dir(path)]
+}
+
+// extraneous lists the local files under the roots that the run did not
+// resolve, sorted. Symlinked directories are not followed, so nothing
+// outside the roots is ever listed.
+func (m *mirror) extraneous() ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var paths []string
+	for root := range m.roots {
+		err := filepath.WalkDir(root, func(path string, e fs.DirEntry, err error) error {
+			if err != nil {
+				if path == root && errors.Is(err, fs.ErrNotExist) {
+					return nil
+				}
+				return err
+			}
+			if !e.IsDir() && !m.kept(path) {
+				paths = append(paths, path)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("unable to list local files: %v", err)
+		}
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// within reports whether path lies inside one of the roots. Extraneous
+// paths always do; this is the last check before anything is deleted.
+func (m *mirror) within(path string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for root := range m.roots {
+		if root == "." || !filepath.IsLocal(root) {
+			continue
+		}
+		if rel, err := filepath.Rel(root, path); err == nil && rel != "." && filepath.IsLocal(rel) {
+			return true
+		}
+	}
+	return false
+}
+
+// deleteExtraneous removes the local files the input folders no longer
+// have, and returns how many were removed. Directories are left in place.
+func (m *mirror) deleteExtraneous() (int, error) {
+	paths, err := m.extraneous()
+	if err != nil {
+		return 0, err
+	}
+	deleted := 0
+	for _, path := range paths {
+		if !m.within(path) {
+			log.Printf("Not deleting %s, it is outside the mirrored folders", path)
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			return deleted, fmt.Errorf("unable to delete extraneous file: %v", err)
+		}
+		log.Printf("Deleted %s, it is no longer in the source", path)
+		deleted++
+	}
+	return deleted, nil
+}
+
+// folderDir returns the local directory the contents of a folder are
+// written to.
+func (d *downloader) folderDir(ctx context.Context, folder *drive.File) (string, error) {
+	p, err := getFolderPath(ctx, d.parents, folder)
+	if err != nil {
+		return "", fmt.Errorf("unable to retrieve folder path: %v", err)
+	}
+	dir, err := d.namer.Name(folder, p)
+	if err != nil {
+		return "", err
+	}
+	return d.normalize(dir), nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// writeFiles creates each of paths, and the folders above it.
+func writeFiles(t *testing.T, paths ...string) {
+	t.Helper()
+	for _, path := range paths {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte("local\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestMirrorKeepsWrittenRevisions(t *testing.T) {
+	t.Chdir(t.TempDir())
+	fd := newFakeDrive(t)
+	seedFixtures(fd)
+	fd.addRevision("small", "r1", "2024-01-01T10:00:00.000Z", []byte("first\n"))
+
+	d := fd.downloader(t)
+	d.mirror = newMirror()
+	d.mirror.addRoot("A")
+	ctx := context.Background()
+	file, err := d.metadata(ctx, "small")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join("A", "B", "small.txt")
+	writeFiles(t, path, filepath.Join("A", "gone.txt"))
+	if err := d.saveRevisions(ctx, file, path, 5); err != nil {
+		t.Fatal(err)
+	}
+	d.mirror.keepPath(path)
+	got, err := d.mirror.extraneous()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{filepath.Join("A", "gone.txt")}; !slices.Equal(got, want) {
+		t.Errorf("extraneous %v, want %v", got, want)
+	}
+}
+
+func TestMirrorKeepsCompanionsOfSkippedFiles(t *testing.T) {
+	t.Chdir(t.TempDir())
+	m := newMirror()
+	m.addRoot("A")
+	keep := []string{
+		filepath.Join("A", "notes.txt"),
+		filepath.Join("A", "notes.txt"+metadataSidecarExt),
+		filepath.Join("A", "notes.txt"+commentsSidecarExt),
+		filepath.Join("A", "notes.rev20240101T100000Z.txt"),
+		filepath.Join("A", "Budget", "Q1.csv"),
+		filepath.Join("A", "Plan_images", "image1.png"),
+	}
+	extraneous := []string{
+		filepath.Join("A", "Budget.csv"),
+		filepath.Join("A", "gone.rev20240101T100000Z.txt"),
+		filepath.Join("A", "gone.txt"+metadataSidecarExt),
+	}
+	writeFiles(t, append(keep, extraneous...)...)
+	m.keepOutputs(filepath.Join("A", "notes.txt"))
+	m.keepOutputs(filepath.Join("A", "Budget.xlsx"), sheetTabsDir(filepath.Join("A", "Budget.xlsx")))
+	m.keepOutputs(filepath.Join("A", "Plan.md"), markdownImagesDir(filepath.Join("A", "Plan.md")))
+
+	got, err := m.extraneous()
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(extraneous)
+	if !slices.Equal(got, extraneous) {
+		t.Errorf("extraneous %v, want %v", got, extraneous)
+	}
+}
+
+func TestDeleteExtraneousKeepsRenamedFolders(t *testing.T) {
+	t.Chdir(t.TempDir())
+	fd := newFakeDrive(t)
+	seedFixtures(fd)
+	// A local file is in the way of folder B, so the download goes to B_dir.
+	writeFiles(t, filepath.Join("A", "B"))
+
+	d := fd.downloader(t)
+	d.onDirConflict = dirConflictRename
+	d.mirror = newMirror()
+	d.mirror.addRoot("A")
+	ctx := context.Background()
+	file, err := d.metadata(ctx, "small")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dest, err := d.resolveFile(ctx, file, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.mirror.keepOutputs(dest)
+	res, err := d.save(ctx, file, dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join("A", "B"+dirConflictSuffix, "small.txt"); res.path != want {
+		t.Fatalf("downloaded to %s, want %s", res.path, want)
+	}
+	n, err := d.mirror.deleteExtraneous()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("deleted %d files, want the local A/B only", n)
+	}
+	checkContent(t, res.path, []byte("hello, drive\n"))
+}
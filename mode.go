@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	"google.golang.org/api/drive/v3"
+)
+
+// Modes --readonly-if-view gives files depending on the user's access.
+const (
+	modeViewOnly os.FileMode = 0444
+	modeEditable os.FileMode = 0644
+)
+
+// parseMode parses the octal value of the mode flag name, such as 0640. An
+// empty value leaves modes alone.
+func parseMode(name, s string) (os.FileMode, error) {
+	if s == "" {
+		return 0, nil
+	}
+	m, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || m > 0777 {
+		return 0, fmt.Errorf("invalid --%s %q, expected octal permission bits such as 0644", name, s)
+	}
+	return os.FileMode(m), nil
+}
+
+// parseDirMode parses --dir-mode, which has to let the owner create files
+// in the folders and enter them, or the download could not go on.
+func parseDirMode(s string) (os.FileMode, error) {
+	m, err := parseMode("dir-mode", s)
+	if err != nil {
+		return 0, err
+	}
+	if m&0300 != 0300 {
+		return 0, fmt.Errorf("invalid --dir-mode %q, the owner needs write and execute permission (0300)", s)
+	}
+	return m, nil
+}
+
+// create creates or truncates an output file like os.Create, but with the
+// --file-mode permissions. Those are the permissions asked for at creation,
+// so the umask still removes bits from them; --chmod sets exact ones
+// afterwards instead.
+func (d *downloader) create(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, d.newFileMode)
+}
+
+// fileMode returns the permissions a downloaded file should get, or 0 to
+// keep the ones os.Create gave it. --readonly-if-view takes precedence over
+// --chmod for the files it applies to.
+func (d *downloader) fileMode(file *drive.File) os.FileMode {
+	if d.readonlyIfView && file.Capabilities != nil {
+		if file.Capabilities.CanEdit {
+			return modeEditable
+		}
+		return modeViewOnly
+	}
+	return d.chmod
+}
+
+// applyMode sets the permissions of a completed download.
+func (d *downloader) applyMode(file *drive.File, dest string) error {
+	mode := d.fileMode(file)
+	if mode == 0 {
+		return nil
+	}
+	if err := os.Chmod(dest, mode); err != nil {
+		return diskErrorf(err, "unable to set file mode: %v", err)
+	}
+	return nil
+}
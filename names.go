@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/text/unicode/norm"
+	"google.golang.org/api/drive/v3"
+)
+
+// parseNormalization maps a --normalize-unicode value to the function applied
+// to every path component. Normalizing keeps names identical across macOS
+// (NFD) and Linux (NFC) so re-runs see the same files.
+func parseNormalization(form string) (func(string) string, error) {
+	switch form {
+	case "nfc":
+		return norm.NFC.String, nil
+	case "nfd":
+		return norm.NFD.String, nil
+	case "none":
+		return func(s string) string { return s }, nil
+	}
+	return nil, fmt.Errorf("unknown unicode normalization %q, expected nfc, nfd or none", form)
+}
+
+// withCase adds the --case transformation to a normalization function.
+// Lowercasing keeps paths that differ only in case from silently
+// clobbering each other on case-insensitive filesystems: they collide in
+// the run instead, and --collision decides.
+func withCase(normalize func(string) string, c string) (func(string) string, error) {
+	switch c {
+	case "preserve":
+		return normalize, nil
+	case "lower":
+		return func(s string) string { return strings.ToLower(normalize(s)) }, nil
+	}
+	return nil, fmt.Errorf("unknown --case %q, expected lower or preserve", c)
+}
+
+// namer computes the output path of a file, relative to the output root,
+// from its metadata and the Drive folder path it lives in.
+type namer interface {
+	Name(file *drive.File, folderPath string) (string, error)
+}
+
+// folderNamer mirrors the Drive folder structure: <folder path>/<name>.
+type folderNamer struct{}
+
+func (folderNamer) Name(file *drive.File, folderPath string) (string, error) {
+	return filepath.Join(folderPath, file.Name), nil
+}
+
+// flatNamer drops the folder structure and writes every file by name into
+// the output root.
+type flatNamer struct{}
+
+func (flatNamer) Name(file *drive.File, folderPath string) (string, error) {
+	return file.Name, nil
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"syscall"
+)
+
+// openFilesReserve is left for stdin/out/err, the log and state files and
+// the odd extra connection.
+const openFilesReserve = 16
+
+// fitConcurrency lowers the download concurrency so that every active
+// download, which holds its output file and a connection, plus a connection
+// per metadata lookup, stays within maxOpen descriptors. A zero maxOpen
+// uses the process limit when it is known.
+func fitConcurrency(concurrency, metadataConcurrency int, maxOpen uint64) (int, error) {
+	if maxOpen == 0 {
+		limit, ok := openFilesLimit()
+		if !ok || limit > 1<<20 {
+			return concurrency, nil
+		}
+		maxOpen = limit
+	}
+	budget := int64(maxOpen) - openFilesReserve - int64(metadataConcurrency)
+	fit := int(budget / 2)
+	if fit < 1 {
+		return 0, fmt.Errorf("an open files limit of %d is too low for --metadata-concurrency %d, raise it with ulimit -n", maxOpen, metadataConcurrency)
+	}
+	return min(concurrency, fit), nil
+}
+
+// isTooManyOpenFiles reports whether err comes from running out of file
+// descriptors. Errors are mostly wrapped as text, so the message is
+// matched too.
+func isTooManyOpenFiles(err error) bool {
+	return errors.Is(err, syscall.EMFILE) || strings.Contains(err.Error(), syscall.EMFILE.Error())
+}
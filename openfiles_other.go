@@ -0,0 +1,8 @@
+//go:build !linux && !darwin
+
+package main
+
+// openFilesLimit is not known on this platform.
+func openFilesLimit() (uint64, bool) {
+	return 0, false
+}
@@ -0,0 +1,16 @@
+//go:build linux || darwin
+
+package main
+
+import "syscall"
+
+// openFilesLimit returns the soft limit on open file descriptors. The Go
+// runtime raises it to the hard limit at startup, so this is the most the
+// process can open.
+func openFilesLimit() (uint64, bool) {
+	var rl syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rl); err != nil {
+		return 0, false
+	}
+	return rl.Cur, true
+}
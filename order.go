@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"google.golang.org/api/drive/v3"
+)
+
+// fileOrder is an --order-by ordering. It sorts the pre-fetched input, and
+// folder listings through Drive's orderBy with the listing key.
+type fileOrder struct {
+	listing string
+	less    func(a, b *drive.File) bool
+}
+
+var fileOrders = map[string]fileOrder{
+	"size-asc":  {"quotaBytesUsed", func(a, b *drive.File) bool { return a.Size < b.Size }},
+	"size-desc": {"quotaBytesUsed desc", func(a, b *drive.File) bool { return a.Size > b.Size }},
+	"name":      {"name", func(a, b *drive.File) bool { return a.Name < b.Name }},
+	"modified":  {"modifiedTime", func(a, b *drive.File) bool { return a.ModifiedTime < b.ModifiedTime }},
+}
+
+// parseOrderBy parses --order-by, where "" keeps the input order.
+func parseOrderBy(s string) (*fileOrder, error) {
+	if s == "" {
+		return nil, nil
+	}
+	o, ok := fileOrders[s]
+	if !ok {
+		return nil, fmt.Errorf("invalid --order-by %q, expected size-asc, size-desc, name or modified", s)
+	}
+	return &o, nil
+}
+
+// sortEntries sorts entries whose metadata is known by o, keeping the input
+// order of ties. Entries without metadata, which are left out anyway, go
+// first.
+func (o *fileOrder) sortEntries(entries []inputEntry) {
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, b := entries[i].file, entries[j].file
+		if a == nil || b == nil {
+			return a == nil && b != nil
+		}
+		return o.less(a, b)
+	})
+}
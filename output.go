@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Values of --output-format.
+const (
+	outputText   = "text"
+	outputNDJSON = "ndjson"
+)
+
+// lineWriter serializes lines written from concurrent downloads so they
+// never interleave on the output.
+//
+// In ndjson mode the text lines are dropped and every file's result is
+// written as a JSON object of its own line instead, as soon as the file is
+// done.
+type lineWriter struct {
+	mu     sync.Mutex
+	w      io.Writer
+	ndjson bool
+}
+
+// newLineWriter returns a lineWriter for the given --output-format.
+func newLineWriter(w io.Writer, format string) (*lineWriter, error) {
+	switch format {
+	case outputText:
+		return &lineWriter{w: w}, nil
+	case outputNDJSON:
+		return &lineWriter{w: w, ndjson: true}, nil
+	}
+	return nil, fmt.Errorf("invalid --output-format %q, expected %s or %s", format, outputText, outputNDJSON)
+}
+
+// printf formats a single line and writes it in one piece.
+func (l *lineWriter) printf(format string, a ...any) {
+	if l.ndjson {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	fmt.Fprintf(l.w, format+"\n", a...)
+}
+
+// record writes the result of a file in ndjson mode. The writer is not
+// buffered, so each line reaches the consumer right away.
+func (l *lineWriter) record(res *result) {
+	l.object(res)
+}
+
+// object writes v as a JSON line in ndjson mode.
+func (l *lineWriter) object(v any) {
+	if !l.ndjson {
+		return
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.w.Write(append(b, '\n'))
+}
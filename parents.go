@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	"golang.org/x/sync/singleflight"
+	"google.golang.org/api/drive/v3"
+)
+
+// parentCache remembers the folders looked up while building folder paths,
+// since the files of a batch mostly share their ancestors. Concurrent
+// lookups of a folder that is not cached yet collapse into a single API call
+// whose result every caller shares. Lookups are retried like any other
+// call; failed ones are not cached.
+type parentCache struct {
+	srv   *drive.Service
+	retry retrier
+
+	mu      sync.Mutex
+	folders map[string]*drive.File
+	group   singleflight.Group
+}
+
+func newParentCache(srv *drive.Service, retry retrier) *parentCache {
+	return &parentCache{srv: srv, retry: retry, folders: map[string]*drive.File{}}
+}
+
+// get returns the name and parents of a folder.
+func (c *parentCache) get(ctx context.Context, id string) (*drive.File, error) {
+	c.mu.Lock()
+	folder, ok := c.folders[id]
+	c.mu.Unlock()
+	if ok {
+		return folder, nil
+	}
+
+	v, err, _ := c.group.Do(id, func() (any, error) {
+		var folder *drive.File
+		err := c.retry.do(ctx, id, func() (err error) {
+			folder, err = c.srv.Files.Get(id).Fields(parentFields).SupportsAllDrives(true).Context(ctx).Do()
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		c.mu.Lock()
+		c.folders[id] = folder
+		c.mu.Unlock()
+		return folder, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*drive.File), nil
+}
+
+// sharedDriveName returns the name of a shared drive, cached under the
+// drive's ID like a folder.
+func (c *parentCache) sharedDriveName(ctx context.Context, id string) (string, error) {
+	c.mu.Lock()
+	folder, ok := c.folders[id]
+	c.mu.Unlock()
+	if ok {
+		return folder.Name, nil
+	}
+
+	v, err, _ := c.group.Do(id, func() (any, error) {
+		var sharedDrive *drive.Drive
+		err := c.retry.do(ctx, id, func() (err error) {
+			sharedDrive, err = c.srv.Drives.Get(id).Fields("name").Context(ctx).Do()
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		folder := &drive.File{Id: id, Name: sharedDrive.Name}
+		c.mu.Lock()
+		c.folders[id] = folder
+		c.mu.Unlock()
+		return folder, nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return v.(*drive.File).Name, nil
+}
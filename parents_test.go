@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFolderLookupsCoalesce(t *testing.T) {
+	fd := newFakeDrive(t)
+	seedFixtures(fd)
+	fd.latency = 50 * time.Millisecond
+
+	d := fd.downloader(t)
+	file, err := d.metadata(context.Background(), "small")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	paths := make([]string, 50)
+	errs := make([]error, len(paths))
+	for i := range paths {
+		wg.Go(func() {
+			paths[i], errs[i] = getFolderPath(context.Background(), d.parents, file)
+		})
+	}
+	wg.Wait()
+	for i, p := range paths {
+		if errs[i] != nil {
+			t.Fatal(errs[i])
+		}
+		if want := filepath.Join("A", "B"); p != want {
+			t.Errorf("folder path %s, want %s", p, want)
+		}
+	}
+	for _, id := range []string{"folderA", "folderB"} {
+		if n := fd.callsTo(routeGet, id); n != 1 {
+			t.Errorf("%d lookups of %s, want 1", n, id)
+		}
+	}
+}
+
+func TestFolderLookupsRetry(t *testing.T) {
+	fd := newFakeDrive(t)
+	seedFixtures(fd)
+	fd.fail(routeGet, "teamFolder", fakeFailure{http.StatusTooManyRequests, "rateLimitExceeded"})
+	fd.fail(routeDrive, "sharedDrive", fakeFailure{http.StatusServiceUnavailable, "backendError"})
+
+	d := fd.downloader(t)
+	file, err := d.metadata(context.Background(), "report")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := getFolderPath(context.Background(), d.parents, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join("Team", "Reports"); p != want {
+		t.Errorf("folder path %s, want %s", p, want)
+	}
+}
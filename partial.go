@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+
+	"google.golang.org/api/drive/v3"
+)
+
+// partialExt marks a download kept unfinished with --keep-partial, and
+// partialMetaExt the sidecar recording which version of the file it holds.
+const (
+	partialExt     = ".partial"
+	partialMetaExt = ".partial.json"
+)
+
+// partialMeta identifies the version of a file a partial download holds.
+// Drive v3 gives files no ETag to send as If-Range, so a partial is only
+// resumed when the metadata fetched now still matches what was recorded
+// when it was started; otherwise the new bytes would be appended to the
+// old content.
+type partialMeta struct {
+	ID           string `json:"id"`
+	Md5Checksum  string `json:"md5Checksum"`
+	Size         int64  `json:"size"`
+	ModifiedTime string `json:"modifiedTime"`
+}
+
+func partialMetaOf(file *drive.File) partialMeta {
+	return partialMeta{file.Id, file.Md5Checksum, file.Size, file.ModifiedTime}
+}
+
+// fetchPartial is fetch for --keep-partial. The file is written to
+// dest.partial, resuming from an earlier run's partial when the file did
+// not change since, and renamed to dest once complete. On failure the
+// partial and its sidecar stay behind for the next run.
+func (d *downloader) fetchPartial(ctx context.Context, file *drive.File, dest string, t *transfer) (int64, error) {
+	part, meta := dest+partialExt, dest+partialMetaExt
+	if d.partials != nil {
+		d.partials.take(file.Id, part)
+	}
+	offset := d.partialOffset(file, part, meta)
+	if offset == 0 {
+		b, err := json.Marshal(partialMetaOf(file))
+		if err == nil {
+			err = os.WriteFile(meta, b, d.newFileMode)
+		}
+		if err != nil {
+			return 0, diskErrorf(err, "unable to write partial download sidecar: %v", err)
+		}
+	}
+	if offset > 0 && offset == file.Size {
+		// Drive answers a range starting at the end with 416, and there is
+		// nothing left to ask for anyway.
+		t.reset()
+		t.skipHashes()
+		t.add(offset)
+		return completePartial(part, meta, dest, offset)
+	}
+
+	resp, err := d.openContent(ctx, file, offset)
+	if err != nil {
+		return 0, err
+	}
+	flags := os.O_WRONLY | os.O_CREATE
+	if offset == 0 || resp.StatusCode != http.StatusPartialContent {
+		flags |= os.O_TRUNC
+		offset = 0
+	}
+	out, err := os.OpenFile(part, flags, d.newFileMode)
+	if err != nil {
+		resp.Body.Close()
+		return 0, diskErrorf(err, "unable to create download file: %v", err)
+	}
+	if _, err := out.Seek(offset, io.SeekStart); err != nil {
+		resp.Body.Close()
+		out.Close()
+		return 0, diskErrorf(err, "unable to resume partial download: %v", err)
+	}
+	t.reset()
+	src := d.resumable(ctx, file, resp)
+	src.read = offset
+	written, err := d.copyContent(ctx, file, out, src, t)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		log.Printf("%s: keeping %s bytes in %s to resume from", file.Id, logBytes(written), part)
+		return 0, diskErrorf(err, "unable to write file content: %v", err)
+	}
+	return completePartial(part, meta, dest, written)
+}
+
+// completePartial moves the finished partial download at part to dest.
+func completePartial(part, meta, dest string, written int64) (int64, error) {
+	if err := os.Rename(part, dest); err != nil {
+		return 0, diskErrorf(err, "unable to move download into place: %v", err)
+	}
+	os.Remove(meta)
+	return written, nil
+}
+
+// partialOffset returns where to resume the partial download at part, or 0
+// after removing it when there is none, its sidecar is missing or the file
+// changed on Drive since.
+func (d *downloader) partialOffset(file *drive.File, part, meta string) int64 {
+	info, err := os.Stat(part)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0
+	}
+	var recorded partialMeta
+	b, err := os.ReadFile(meta)
+	if err == nil {
+		err = json.Unmarshal(b, &recorded)
+	}
+	switch {
+	case err != nil:
+		log.Printf("%s: %s has no readable sidecar, downloading from scratch", file.Id, part)
+	case recorded != partialMetaOf(file) || recorded.Md5Checksum == "":
+		log.Printf("%s: file changed on Drive since %s was written, downloading from scratch", file.Id, part)
+	case info.Size() > file.Size:
+		log.Printf("%s: %s is larger than the file, downloading from scratch", file.Id, part)
+	case info.Size() == file.Size:
+		// An earlier run was stopped between the last byte and the rename.
+		sum, err := fileMD5(part)
+		if err == nil && sum == file.Md5Checksum {
+			log.Printf("%s: %s is complete", file.Id, part)
+			return info.Size()
+		}
+		log.Printf("%s: %s is complete but does not match the file, downloading from scratch", file.Id, part)
+	default:
+		log.Printf("%s: resuming %s from %s", file.Id, part, logBytes(info.Size()))
+		return info.Size()
+	}
+	os.Remove(part)
+	return 0
+}
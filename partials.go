@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// partialSet is the partial downloads earlier runs left behind, found when
+// a --keep-partial run starts. They are matched to files by the ID in their
+// sidecar, so a file whose output path changed since still resumes.
+type partialSet struct {
+	mu sync.Mutex
+	// byID maps file IDs to their partial downloads.
+	byID map[string]string
+	// unknown are partials without a readable sidecar.
+	unknown []string
+	// taken are the IDs this run downloaded with --keep-partial.
+	taken map[string]bool
+}
+
+// findPartials looks for partial downloads under each of dirs. Symlinked
+// directories are not followed.
+func findPartials(dirs ...string) (*partialSet, error) {
+	s := &partialSet{byID: map[string]string{}, taken: map[string]bool{}}
+	for _, dir := range dirs {
+		if dir == "" {
+			continue
+		}
+		err := filepath.WalkDir(dir, func(path string, e fs.DirEntry, err error) error {
+			if err != nil {
+				if path == dir && errors.Is(err, fs.ErrNotExist) {
+					return nil
+				}
+				return err
+			}
+			if e.IsDir() || !strings.HasSuffix(path, partialExt) {
+				return nil
+			}
+			id, ok := readPartialID(strings.TrimSuffix(path, partialExt) + partialMetaExt)
+			if !ok {
+				s.unknown = append(s.unknown, path)
+				return nil
+			}
+			s.byID[id] = path
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("unable to look for partial downloads: %v", err)
+		}
+	}
+	return s, nil
+}
+
+// readPartialID returns the file ID recorded in a partial's sidecar.
+func readPartialID(meta string) (string, bool) {
+	b, err := os.ReadFile(meta)
+	if err != nil {
+		return "", false
+	}
+	var m partialMeta
+	if err := json.Unmarshal(b, &m); err != nil || m.ID == "" {
+		return "", false
+	}
+	return m.ID, true
+}
+
+// count returns how many partials were found.
+func (s *partialSet) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.byID) + len(s.unknown)
+}
+
+// take claims the partial of fileID for a download to part. A partial
+// found at another path, because the file was renamed or moved on Drive or
+// the output layout changed, is moved to part together with its sidecar,
+// unless part already holds one.
+func (s *partialSet) take(fileID, part string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.taken[fileID] = true
+	found, ok := s.byID[fileID]
+	if !ok || filepath.Clean(found) == filepath.Clean(part) {
+		return
+	}
+	if _, err := os.Stat(part); err == nil {
+		return
+	}
+	if err := os.Rename(found, part); err != nil {
+		log.Printf("%s: unable to move partial download %s: %v", fileID, found, err)
+		return
+	}
+	os.Rename(strings.TrimSuffix(found, partialExt)+partialMetaExt, strings.TrimSuffix(part, partialExt)+partialMetaExt)
+	log.Printf("%s: moved partial download %s to %s", fileID, found, part)
+	s.byID[fileID] = part
+}
+
+// orphans lists the partials that still exist and belong to no file this
+// run downloaded, sorted.
+func (s *partialSet) orphans() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var paths []string
+	for id, path := range s.byID {
+		if !s.taken[id] {
+			paths = append(paths, path)
+		}
+	}
+	paths = append(paths, s.unknown...)
+	kept := paths[:0]
+	for _, path := range paths {
+		if _, err := os.Stat(path); err == nil {
+			kept = append(kept, path)
+		}
+	}
+	sort.Strings(kept)
+	return kept
+}
+
+// reportOrphans logs the partials no input file matched, and removes them
+// with their sidecars when clean is set.
+func (s *partialSet) reportOrphans(clean bool) {
+	orphans := s.orphans()
+	if len(orphans) == 0 {
+		return
+	}
+	if !clean {
+		log.Printf("%d partial downloads match no file of this run, remove them with --clean-partials:", len(orphans))
+		for _, path := range orphans {
+			log.Printf("  %s", path)
+		}
+		return
+	}
+	removed := 0
+	for _, path := range orphans {
+		if err := os.Remove(path); err != nil {
+			log.Printf("Unable to remove partial download: %v", err)
+			continue
+		}
+		os.Remove(strings.TrimSuffix(path, partialExt) + partialMetaExt)
+		removed++
+	}
+	log.Printf("Removed %d partial downloads that match no file of this run", removed)
+}
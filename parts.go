@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+	"google.golang.org/api/drive/v3"
+)
+
+// defaultPartsMinSize is the smallest file --parallel-file-parts splits by
+// default. Below it the extra requests cost more than they save.
+const defaultPartsMinSize = "100M"
+
+// errRangeIgnored is a ranged request answered with the whole file, which
+// leaves the download to a single stream.
+var errRangeIgnored = errors.New("byte range ignored by Drive")
+
+// splitsIntoParts reports whether file is downloaded in --parallel-file-parts
+// ranges. Exports have no ranges, compression and --sink need the bytes in
+// order and partial downloads and quota copies keep to one stream of their
+// own.
+func (d *downloader) splitsIntoParts(file *drive.File) bool {
+	return d.parts > 1 && file.Size >= d.partsMinSize && file.Size >= int64(d.parts) &&
+		!isNative(file) && !d.gunzip && !d.gzip && !d.keepPartial && d.quotaCopies == nil && d.sink == nil
+}
+
+// fetchParts writes file to dest in d.parts byte ranges downloaded at once,
+// each written at its offset of the preallocated file. A broken range is
+// resumed from its last byte like a single stream would be. As the hashes
+// cannot be streamed out of order, the md5 is checked by reading the file
+// back, here unless --verify does it anyway. Nothing is left behind at dest
+// on failure; errRangeIgnored means the file can still be downloaded in
+// one piece.
+func (d *downloader) fetchParts(ctx context.Context, file *drive.File, dest string, t *transfer) (int64, error) {
+	if m := d.fileMode(file); (m != 0 && m&0200 == 0) || d.newFileMode&0200 == 0 {
+		os.Remove(dest)
+	}
+	out, err := d.create(dest)
+	if err != nil {
+		return 0, diskErrorf(err, "unable to create download file: %v", err)
+	}
+	fail := func(err error) (int64, error) {
+		out.Close()
+		os.Remove(dest)
+		t.reset()
+		return 0, err
+	}
+	if err := out.Truncate(file.Size); err != nil {
+		return fail(diskErrorf(err, "unable to allocate download file: %v", err))
+	}
+	t.reset()
+	t.skipHashes()
+
+	g, gctx := errgroup.WithContext(ctx)
+	size := file.Size / int64(d.parts)
+	for i := range d.parts {
+		start, end := int64(i)*size, int64(i+1)*size-1
+		if i == d.parts-1 {
+			end = file.Size - 1
+		}
+		g.Go(func() error {
+			return d.fetchPart(gctx, file, out, start, end, t)
+		})
+	}
+	if err := g.Wait(); err != nil {
+		// Drive errors such as errDownloadQuota are passed on as they are,
+		// as from a single stream; only failed writes are disk errors.
+		var pathErr *fs.PathError
+		if errors.As(err, &pathErr) {
+			err = diskErrorf(err, "unable to write file content: %v", err)
+		}
+		return fail(err)
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(dest)
+		return 0, diskErrorf(err, "unable to write file content: %v", err)
+	}
+	if !d.verifyMD5 && file.Md5Checksum != "" {
+		sum, err := fileMD5(dest)
+		if err == nil && sum != file.Md5Checksum {
+			err = &checksumError{got: sum, want: file.Md5Checksum}
+		}
+		if err != nil {
+			os.Remove(dest)
+			return 0, err
+		}
+	}
+	return file.Size, nil
+}
+
+// fetchPart downloads the bytes from start to end, included, of file into
+// out, asking for what is left of the range again when the transfer breaks.
+func (d *downloader) fetchPart(ctx context.Context, file *drive.File, out *os.File, start, end int64, t *transfer) error {
+	buf := d.buffers.Get().(*[]byte)
+	defer d.buffers.Put(buf)
+
+	offset := start
+	for failures := 0; ; {
+		resp, err := d.openRange(ctx, file, offset, end)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusPartialContent {
+			resp.Body.Close()
+			if offset == start && failures == 0 {
+				return errRangeIgnored
+			}
+			return fmt.Errorf("byte range %d-%d ignored by Drive", offset, end)
+		}
+		w := countingWriter{io.NewOffsetWriter(out, offset), t}
+		n, err := io.CopyBuffer(w, io.LimitReader(resp.Body, end-offset+1), *buf)
+		resp.Body.Close()
+		offset += n
+		if n > 0 {
+			failures = 0
+		}
+		if err == nil && offset <= end {
+			err = io.ErrUnexpectedEOF
+		}
+		if err == nil {
+			return nil
+		}
+		var pathErr *fs.PathError
+		if errors.As(err, &pathErr) {
+			// Writing failed; asking Drive again would not help.
+			return err
+		}
+		retries := d.retry.maxRetries
+		if ctx.Err() != nil || failures >= retries {
+			return err
+		}
+		if d.retry.budget != nil && !d.retry.budget.take() {
+			return err
+		}
+		failures++
+		delay := backoff(failures - 1)
+		d.retry.log.record(file.Id, failures, retries, causeTransfer, err, delay)
+		log.Printf("%s: bytes %d-%d interrupted at %s (%v), resuming in %v (%d/%d)", file.Id, start, end, logBytes(offset-start), err, delay, failures, retries)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
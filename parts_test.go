@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"sync"
+	"testing"
+)
+
+func TestPartsDownload(t *testing.T) {
+	t.Chdir(t.TempDir())
+	fd := newFakeDrive(t)
+	seedFixtures(fd)
+	fd.cut("large", 200<<10)
+
+	d := fd.downloader(t)
+	d.parts, d.partsMinSize = 4, 1<<20
+	var mu sync.Mutex
+	var reported []int64
+	d.progress = func(fileID string, bytesSoFar, totalBytes int64) {
+		mu.Lock()
+		defer mu.Unlock()
+		reported = append(reported, bytesSoFar)
+	}
+	dest, err := saveByID(t, d, "large")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkContent(t, dest, largeFixture)
+	// Four ranges, one of them broken off and asked for again.
+	if n := fd.callsTo(routeMedia, "large"); n != 5 {
+		t.Errorf("%d media requests, want 5", n)
+	}
+	for i := 1; i < len(reported); i++ {
+		if reported[i] <= reported[i-1] {
+			t.Fatalf("progress went from %d to %d", reported[i-1], reported[i])
+		}
+	}
+	if last := reported[len(reported)-1]; last != int64(len(largeFixture)) {
+		t.Errorf("last progress %d, want %d", last, len(largeFixture))
+	}
+}
+
+func TestPartsQuotaExceeded(t *testing.T) {
+	t.Chdir(t.TempDir())
+	fd := newFakeDrive(t)
+	seedFixtures(fd)
+	fd.fail(routeMedia, "large", fakeFailure{http.StatusForbidden, "downloadQuotaExceeded"})
+
+	d := fd.downloader(t)
+	d.parts, d.partsMinSize = 4, 1<<20
+	dest, err := saveByID(t, d, "large")
+	if !errors.Is(err, errDownloadQuota) {
+		t.Fatalf("got %v, want errDownloadQuota", err)
+	}
+	if _, err := os.Stat(dest); !os.IsNotExist(err) {
+		t.Errorf("%s was left behind", dest)
+	}
+	// One part was refused; the file is not downloaded again over it.
+	if n := fd.callsTo(routeMedia, "large"); n > 4 {
+		t.Errorf("%d media requests, want at most 4", n)
+	}
+}
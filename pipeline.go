@@ -0,0 +1,487 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/sync/semaphore"
+	"google.golang.org/api/drive/v3"
+)
+
+// pipeline drives each input entry through metadata resolution and the
+// download, under the concurrency limits of each phase. Entries come from
+// stdin and, with --recursive, from the folders being walked.
+type pipeline struct {
+	d           *downloader
+	walker      *walker
+	disk        *diskGuard
+	stdout      *lineWriter
+	resolveOnly bool
+	dryRun      bool
+	verifyOnly  bool
+	repair      bool
+	verified    verifyCounts
+	filter      *idFilter
+	// mirror, when set, collects what --dry-run needs to list local files
+	// that are not in the source.
+	mirror *mirror
+	// manifest, when set, is the --verify-against manifest every download
+	// is checked against.
+	manifest *checksumManifest
+	// tree, when set, collects the walked folders for --dump-tree.
+	tree *folderTree
+	// names, when set, makes input lines file names to look up in a folder
+	// rather than IDs.
+	names *nameLookup
+	// linkedFiles also downloads the files Google Docs link to.
+	linkedFiles bool
+	failFast    bool
+	cancel      context.CancelFunc
+	// maxFiles caps the number of files queued for download, 0 meaning no
+	// cap. queued counts them, across input entries and walked folders.
+	maxFiles int64
+	queued   atomic.Int64
+	capped   sync.Once
+	// onDiskError is what --on-disk-error does with filesystem failures;
+	// diskFailed is set once one aborted the run.
+	onDiskError string
+	diskFailed  atomic.Bool
+	// maxAPICalls is the --max-api-calls limit, 0 meaning none.
+	maxAPICalls int64
+	// plannedCalls estimates the downloads and exports of the --dry-run
+	// plan in API requests.
+	plannedCalls atomic.Int64
+	// xattrIDs, with --xattr-id, records the Drive ID of every download in
+	// an extended attribute.
+	xattrIDs *xattrIDs
+	// markdownImages extracts the images embedded in Markdown exports.
+	markdownImages bool
+	// revisions is how many earlier revisions of each stored file to save
+	// next to it.
+	revisions int
+	// order, when set, is the order pre-fetched entries are dispatched in.
+	order *fileOrder
+
+	// Resolving metadata and folder paths is cheap per call but dominates on
+	// deep trees, while byte transfers compete for bandwidth, so each phase
+	// has its own limit.
+	metaSem *semaphore.Weighted
+	sem     *semaphore.Weighted
+	// smallSem, when set, holds download slots only files smaller than
+	// smallSize may take, so that they keep flowing while large transfers
+	// fill sem.
+	smallSem  *semaphore.Weighted
+	smallSize int64
+	// perDrive, when set, also limits the downloads of each shared drive.
+	// Its slot is taken before a global one, so that files waiting on a
+	// busy drive do not hold slots other drives could use.
+	perDrive *driveSlots
+
+	// start governs starting new work, and is cancelled earlier than the
+	// run's own context when stopping gracefully, through stopStarting.
+	start        context.Context
+	stopStarting context.CancelFunc
+	// report collects per-file results when --report or --catalog is set.
+	report *report
+	// index records downloaded files when --index-db is set.
+	index *index
+
+	// deferred are the entries whose folder path is to be resolved again in
+	// a second pass.
+	deferredMu sync.Mutex
+	deferred   []inputEntry
+
+	tooManyFiles sync.Once
+
+	wg         sync.WaitGroup
+	failed     atomic.Bool
+	incomplete atomic.Bool
+}
+
+// submit processes entry on a goroutine of its own. done, if set, is called
+// once the entry has been handled.
+func (p *pipeline) submit(ctx context.Context, entry inputEntry, done func()) {
+	// Files whose metadata is known are counted against --max-files in
+	// submission order, so that the files kept follow the listing order.
+	if entry.file != nil && !entry.retry && !p.admit(entry.file) {
+		if done != nil {
+			done()
+		}
+		return
+	}
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		if done != nil {
+			defer done()
+		}
+		if res := p.process(ctx, entry); res != nil {
+			p.record(res)
+		}
+	}()
+}
+
+// record reports the result of an entry, and aborts the run on failures
+// with --fail-fast.
+func (p *pipeline) record(res *result) {
+	if p.report != nil {
+		p.report.add(res)
+	}
+	p.stdout.record(res)
+	if p.index != nil && res.Status == statusDownloaded {
+		if err := p.index.record(res); err != nil {
+			log.Print(err)
+		}
+	}
+	switch res.Status {
+	case statusFailed, statusQuota:
+		log.Printf("%s: %s", res.ID, res.Error)
+		p.d.stats.failed.Add(1)
+		if p.failFast {
+			p.failed.Store(true)
+			p.cancel()
+		}
+	case statusNotStarted:
+		p.incomplete.Store(true)
+	}
+}
+
+// wait blocks until every submitted entry, including the contents of walked
+// folders, has been handled. Entries whose folder path could not be
+// resolved are then processed once more, and those that fail again are
+// reported as failed.
+func (p *pipeline) wait(ctx context.Context) {
+	p.wg.Wait()
+
+	p.deferredMu.Lock()
+	deferred := p.deferred
+	p.deferred = nil
+	p.deferredMu.Unlock()
+	if len(deferred) == 0 {
+		return
+	}
+	if p.start.Err() != nil {
+		for _, entry := range deferred {
+			p.record(p.interrupted(&result{ID: entry.id, Name: entry.file.Name}))
+		}
+		return
+	}
+	log.Printf("Resolving the folder paths of %d files again", len(deferred))
+	for _, entry := range deferred {
+		p.submit(ctx, entry, nil)
+	}
+	p.wg.Wait()
+}
+
+// admit counts file against --max-files, reporting whether it is still
+// within the cap. Folders and filtered out files do not count.
+func (p *pipeline) admit(file *drive.File) bool {
+	if p.maxFiles == 0 || file.MimeType == folderMimeType || p.filter.excludes(file.Id) || !p.filter.allows(file.Id) {
+		return true
+	}
+	if p.queued.Add(1) <= p.maxFiles {
+		return true
+	}
+	p.capped.Do(func() {
+		log.Printf("Reached --max-files %d, leaving out the remaining files", p.maxFiles)
+	})
+	return false
+}
+
+// full reports whether --max-files has been reached, after which folders
+// need not be listed any further.
+func (p *pipeline) full() bool {
+	return p.maxFiles > 0 && p.queued.Load() >= p.maxFiles
+}
+
+// deferEntry queues entry for the second pass of wait.
+func (p *pipeline) deferEntry(entry inputEntry) {
+	p.deferredMu.Lock()
+	defer p.deferredMu.Unlock()
+	p.deferred = append(p.deferred, entry)
+}
+
+// process resolves and downloads a single entry, or walks it if it is a
+// folder. It returns nil for entries that need no report entry: excluded
+// ones and folders that were walked successfully.
+//
+// New work is only started while p.start is live. Once it is cancelled the
+// remaining entries are reported as not started, while those already
+// downloading carry on under ctx.
+func (p *pipeline) process(ctx context.Context, entry inputEntry) *result {
+	if p.names != nil && entry.file == nil {
+		return p.lookup(ctx, entry)
+	}
+	res := &result{ID: entry.id}
+	if p.filter.excludes(entry.id) {
+		p.filter.count(false)
+		return nil
+	}
+	if err := p.metaSem.Acquire(p.start, 1); err != nil {
+		return p.interrupted(res)
+	}
+	file := entry.file
+	var err error
+	if file == nil {
+		file, err = p.d.metadata(ctx, entry.id)
+	}
+	if err == nil {
+		file = p.d.forceType(file, entry.parent == "" && entry.dir == "")
+	}
+	if err == nil && file.MimeType != folderMimeType {
+		allowed := p.filter.allows(file.Id)
+		if !entry.retry {
+			p.filter.count(allowed)
+		}
+		if !allowed {
+			p.metaSem.Release(1)
+			return nil
+		}
+	}
+	if err == nil && entry.file == nil && !p.admit(file) {
+		p.metaSem.Release(1)
+		return nil
+	}
+	var dest string
+	switch {
+	case err != nil || file.MimeType == folderMimeType:
+	case entry.dir != "":
+		dest = p.d.resolveInto(file, entry.dir)
+	default:
+		dest, err = p.d.resolveFile(ctx, file, entry.output)
+	}
+	p.metaSem.Release(1)
+	if err != nil {
+		var pathErr *pathError
+		if errors.As(err, &pathErr) && !entry.retry && ctx.Err() == nil {
+			log.Printf("%s: %v, trying again after the rest of the batch", entry.id, err)
+			entry.file, entry.retry = file, true
+			p.deferEntry(entry)
+			return nil
+		}
+		return p.fail(ctx, res, err)
+	}
+	res.Name, res.Path, res.file = file.Name, dest, file
+
+	if file.MimeType == folderMimeType {
+		if p.walker == nil && entry.id == rootKeyword {
+			if err := p.listRoot(ctx, file.Id); err != nil {
+				if p.start.Err() != nil {
+					return p.interrupted(res)
+				}
+				return p.fail(ctx, res, err)
+			}
+			return nil
+		}
+		if p.walker == nil {
+			return p.fail(ctx, res, fmt.Errorf("%s is a folder, use --recursive to download its contents", file.Name))
+		}
+		if p.mirror != nil && entry.parent == "" {
+			dir, err := p.d.folderDir(ctx, file)
+			if err != nil {
+				return p.fail(ctx, res, err)
+			}
+			p.mirror.addRoot(dir)
+		}
+		if p.tree != nil && entry.parent == "" {
+			p.tree.addRoot(file)
+		}
+		if err := p.walker.walk(ctx, file.Id); err != nil {
+			if p.start.Err() != nil {
+				return p.interrupted(res)
+			}
+			return p.fail(ctx, res, err)
+		}
+		return nil
+	}
+	if p.mirror != nil {
+		p.mirror.keepOutputs(dest, p.companionDirs(file, dest)...)
+	}
+	if p.resolveOnly {
+		p.stdout.printf("%s\t%s", file.Id, dest)
+		res.Status = statusResolved
+		return res
+	}
+	if p.dryRun {
+		action, err := p.d.planAction(file, dest)
+		if err != nil {
+			return p.fail(ctx, res, err)
+		}
+		p.stdout.printf("%s\t%s\t%s", action, file.Id, dest)
+		p.plannedCalls.Add(p.contentCalls(file, action))
+		res.Status, res.Outcome = statusPlanned, action
+		return res
+	}
+	repair := false
+	if p.verifyOnly {
+		outcome, err := verifyLocal(file, dest)
+		if err != nil {
+			return p.fail(ctx, res, err)
+		}
+		if outcome == verifyMissing && p.xattrIDs != nil {
+			// The file may have been moved since it was downloaded.
+			if moved, ok := p.xattrIDs.find(file.Id); ok {
+				if outcome, err = verifyLocal(file, moved); err != nil {
+					return p.fail(ctx, res, err)
+				}
+				dest, res.Path = moved, moved
+			}
+		}
+		p.verified.add(outcome)
+		p.stdout.printf("%s\t%s\t%s", outcome, file.Id, dest)
+		res.Status, res.Outcome = statusVerified, outcome
+		if !p.repair || (outcome != verifyMismatch && outcome != verifyMissing) {
+			return res
+		}
+		repair = true
+	}
+
+	// A download paused for disk space does not hold a slot meanwhile.
+	if err := p.disk.wait(p.start); err != nil {
+		if p.start.Err() != nil {
+			return p.interrupted(res)
+		}
+		return p.fail(ctx, res, err)
+	}
+	release, err := p.acquireSlot(file)
+	if err != nil {
+		return p.interrupted(res)
+	}
+	defer release()
+	var out saved
+	if repair {
+		out, err = p.d.saveContent(ctx, file, dest)
+	} else {
+		out, err = p.d.save(ctx, file, dest)
+	}
+	if out.path != "" {
+		res.Path = out.path
+	}
+	res.Bytes, res.Trashed = out.bytes, out.trashed
+	if err != nil {
+		return p.fail(ctx, res, err)
+	}
+	if p.manifest != nil && !out.skipped {
+		if err := p.manifest.check(dest, res.Path); err != nil {
+			return p.fail(ctx, res, err)
+		}
+	}
+	res.Status = statusDownloaded
+	if out.skipped {
+		res.Status = statusSkipped
+	}
+	if p.xattrIDs != nil && p.d.sink == nil && p.d.cas == nil {
+		if _, err := os.Stat(res.Path); err == nil {
+			p.xattrIDs.set(res.Path, file.Id)
+		}
+	}
+	if p.markdownImages && !out.skipped && isNative(file) && p.d.exportExtension(file) == extensionFor(markdownMimeType) {
+		if images, err := p.d.extractMarkdownImages(res.Path); err != nil {
+			log.Printf("Warning: %s: %v", file.Id, err)
+		} else if len(images) > 0 {
+			for _, image := range images {
+				p.mirror.keepPath(image)
+			}
+			log.Printf("%s: extracted %d images from %s", file.Id, len(images), res.Path)
+		}
+	}
+	if p.revisions > 0 && !out.skipped && !isNative(file) {
+		if err := p.d.saveRevisions(ctx, file, res.Path, p.revisions); err != nil {
+			log.Printf("Warning: %s: %v", file.Id, err)
+		}
+	}
+	if p.linkedFiles && file.MimeType == googleDocMimeType && entry.dir == "" {
+		if err := p.downloadLinked(ctx, file.Id, res.Path); err != nil {
+			log.Printf("Warning: %s: %v", file.Id, err)
+		}
+	}
+	return res
+}
+
+// companionDirs are the folders named after dest that the run writes the
+// sheet tabs or Markdown images of file to.
+func (p *pipeline) companionDirs(file *drive.File, dest string) []string {
+	var dirs []string
+	if p.d.sheets != nil && file.MimeType == spreadsheetMimeType {
+		dirs = append(dirs, sheetTabsDir(dest))
+	}
+	if p.markdownImages && isNative(file) && p.d.exportExtension(file) == extensionFor(markdownMimeType) {
+		dirs = append(dirs, markdownImagesDir(dest))
+	}
+	return dirs
+}
+
+// acquireSlot waits for a download slot for file. Small files take a shared
+// slot when one is free and a reserved one otherwise.
+func (p *pipeline) acquireSlot(file *drive.File) (func(), error) {
+	if p.perDrive == nil {
+		return p.acquireGlobal(file)
+	}
+	releaseDrive, err := p.perDrive.acquire(p.start, file.DriveId)
+	if err != nil {
+		return nil, err
+	}
+	release, err := p.acquireGlobal(file)
+	if err != nil {
+		releaseDrive()
+		return nil, err
+	}
+	return func() {
+		release()
+		releaseDrive()
+	}, nil
+}
+
+// acquireGlobal waits for one of the --concurrency slots.
+func (p *pipeline) acquireGlobal(file *drive.File) (func(), error) {
+	sem := p.sem
+	if p.smallSem != nil && !isNative(file) && file.Size < p.smallSize {
+		if p.sem.TryAcquire(1) {
+			return func() { p.sem.Release(1) }, nil
+		}
+		sem = p.smallSem
+	}
+	if err := sem.Acquire(p.start, 1); err != nil {
+		return nil, err
+	}
+	return func() { sem.Release(1) }, nil
+}
+
+// fail marks res as failed with err. Errors caused by a fail-fast abort
+// cancelling ctx are not failures of their own; the file just did not get
+// done.
+func (p *pipeline) fail(ctx context.Context, res *result, err error) *result {
+	if ctx.Err() != nil {
+		return p.interrupted(res)
+	}
+	if p.maxAPICalls > 0 && p.d.stats.apiCalls.Load() >= p.maxAPICalls {
+		// The file most likely failed on a request the limit refused.
+		return p.interrupted(res)
+	}
+	if isTooManyOpenFiles(err) {
+		p.tooManyFiles.Do(func() {
+			log.Print("Ran out of open files: lower --concurrency or --metadata-concurrency, set --max-open-files, or raise the limit with ulimit -n")
+		})
+	}
+	var diskErr *diskError
+	if p.onDiskError == onDiskErrorAbort && errors.As(err, &diskErr) && !p.diskFailed.Swap(true) {
+		log.Printf("%s: %v, not starting new downloads as --on-disk-error=abort asks", res.ID, err)
+		p.stopStarting()
+	}
+	res.Status, res.Error = statusFailed, err.Error()
+	if errors.Is(err, errDownloadQuota) {
+		res.Status = statusQuota
+	}
+	return res
+}
+
+// interrupted marks res as not done because the run is stopping.
+func (p *pipeline) interrupted(res *result) *result {
+	res.Status = statusNotStarted
+	return res
+}
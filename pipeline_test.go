@@ -0,0 +1,26 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestDiskErrorAbortStopsGracefully(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	start, stopStarting := context.WithCancel(ctx)
+	defer stopStarting()
+	p := &pipeline{d: &downloader{stats: newStats()}, onDiskError: onDiskErrorAbort, cancel: cancel, start: start, stopStarting: stopStarting}
+
+	res := p.fail(ctx, &result{ID: "small"}, &diskError{errors.New("no space left on device")})
+	if res.Status != statusFailed || !p.diskFailed.Load() {
+		t.Errorf("got status %s, disk failure %v", res.Status, p.diskFailed.Load())
+	}
+	if start.Err() == nil {
+		t.Error("new work can still start")
+	}
+	if ctx.Err() != nil {
+		t.Error("the downloads in flight were cancelled")
+	}
+}
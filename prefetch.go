@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+
+	"google.golang.org/api/googleapi"
+)
+
+// prefetch fetches the metadata of every input entry before anything is
+// downloaded, and logs a pre-flight summary of what was found. Entries whose
+// metadata could not be fetched are reported as failed right away; the rest
+// are returned, with their metadata, to be processed as usual. With
+// --fail-fast, any failure aborts the run before the first download. With
+// --order-by the entries are returned in that order.
+func (p *pipeline) prefetch(ctx context.Context, entries []inputEntry) []inputEntry {
+	errs := make([]error, len(entries))
+	var wg sync.WaitGroup
+	for i := range entries {
+		if p.filter.excludes(entries[i].id) {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if errs[i] = p.metaSem.Acquire(p.start, 1); errs[i] != nil {
+				return
+			}
+			defer p.metaSem.Release(1)
+			entries[i].file, errs[i] = p.d.metadata(ctx, entries[i].id)
+		}()
+	}
+	wg.Wait()
+
+	var files, folders, notFound, forbidden, other int
+	var size int64
+	ready := make([]inputEntry, 0, len(entries))
+	for i, entry := range entries {
+		err := errs[i]
+		switch {
+		case err != nil:
+			var apiErr *googleapi.Error
+			switch {
+			case p.start.Err() != nil:
+			case errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound:
+				notFound++
+			case errors.As(err, &apiErr) && apiErr.Code == http.StatusForbidden:
+				forbidden++
+			default:
+				other++
+			}
+			res := &result{ID: entry.id}
+			if p.start.Err() != nil {
+				p.record(p.interrupted(res))
+			} else {
+				p.record(p.fail(ctx, res, err))
+			}
+			continue
+		case entry.file == nil:
+			// Excluded, left to process to skip.
+		case entry.file.MimeType == folderMimeType:
+			folders++
+		default:
+			files++
+			size += entry.file.Size
+		}
+		ready = append(ready, entry)
+	}
+	log.Printf("Pre-flight: %d files (%s), %d folders, %d not found, %d not accessible, %d other errors",
+		files, logBytes(size), folders, notFound, forbidden, other)
+	p.d.stats.total.Add(size)
+	if p.order != nil {
+		p.order.sortEntries(ready)
+	}
+	return ready
+}
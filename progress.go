@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+// logProgress logs a line per in-flight download every interval, giving
+// progress visibility where there is no terminal to draw on, such as CI.
+// It returns when ctx is done.
+func (s *stats) logProgress(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	last := map[*transfer]int64{}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		s.mu.Lock()
+		current := make([]*transfer, 0, len(s.inFlight))
+		for t := range s.inFlight {
+			current = append(current, t)
+		}
+		s.mu.Unlock()
+
+		seen := map[*transfer]int64{}
+		for _, t := range current {
+			written := t.written.Load()
+			// Transfers seen for the first time are averaged since they
+			// started, the others over the last interval.
+			prev, window := last[t], interval
+			if _, ok := last[t]; !ok {
+				window = time.Since(t.started)
+			}
+			rate := float64(written-prev) / window.Seconds()
+			seen[t] = written
+			logTransfer(t, written, rate)
+		}
+		last = seen
+	}
+}
+
+// logTransfer logs the progress of a single download.
+// With --stream-hash, the hashes of what was written so far are added.
+func logTransfer(t *transfer, written int64, rate float64) {
+	var line string
+	if t.size <= 0 {
+		line = fmt.Sprintf("%s: %s, %s/s", t.path, logBytes(written), logBytes(int64(rate)))
+	} else {
+		eta := "unknown"
+		if rate > 0 {
+			eta = time.Duration(float64(t.size-written) / rate * float64(time.Second)).Round(time.Second).String()
+		}
+		line = fmt.Sprintf("%s: %.1f%% (%s of %s), %s/s, ETA %s",
+			t.path, float64(written)*100/float64(t.size), logBytes(written), logBytes(t.size), logBytes(int64(rate)), eta)
+	}
+	if sums := t.sums(); sums != "" && t.showHashes {
+		line += ", so far " + sums
+	}
+	log.Print(line)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// progressLogInterval is how often --progress-log reports a file while it
+// is being written.
+const progressLogInterval = time.Second
+
+// progressLog appends a JSON line to --progress-log as downloads are
+// written, for wrappers that render their own progress. It is the
+// downloader's progressFunc, throttled to a line per file every
+// progressLogInterval plus one when the file is complete, so it stays cheap
+// on the copying goroutine.
+type progressLog struct {
+	mu   sync.Mutex
+	f    *os.File
+	enc  *json.Encoder
+	last map[string]time.Time
+}
+
+// progressEntry is one line of the --progress-log. Size is 0 for exports,
+// whose size is not known up front.
+type progressEntry struct {
+	Time  time.Time `json:"time"`
+	ID    string    `json:"id"`
+	Bytes int64     `json:"bytes"`
+	Size  int64     `json:"size"`
+}
+
+func openProgressLog(path string) (*progressLog, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open progress log: %v", err)
+	}
+	return &progressLog{f: f, enc: json.NewEncoder(f), last: map[string]time.Time{}}, nil
+}
+
+// report is a progressFunc writing the progress of fileID.
+func (l *progressLog) report(fileID string, bytesSoFar, totalBytes int64) {
+	now := time.Now()
+	done := totalBytes > 0 && bytesSoFar >= totalBytes
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if last, ok := l.last[fileID]; ok && !done && now.Sub(last) < progressLogInterval {
+		return
+	}
+	if done {
+		delete(l.last, fileID)
+	} else {
+		l.last[fileID] = now
+	}
+	l.enc.Encode(progressEntry{Time: now.UTC(), ID: fileID, Bytes: bytesSoFar, Size: totalBytes})
+}
+
+func (l *progressLog) Close() error {
+	return l.f.Close()
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestProgressLogThrottles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "progress.jsonl")
+	l, err := openProgressLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n := int64(10); n <= 100; n += 10 {
+		l.report("id", n, 100)
+	}
+	l.report("export", 5, 0)
+	l.Close()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var got []progressEntry
+	for sc := bufio.NewScanner(f); sc.Scan(); {
+		var e progressEntry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, e)
+	}
+	want := []progressEntry{{ID: "id", Bytes: 10, Size: 100}, {ID: "id", Bytes: 100, Size: 100}, {ID: "export", Bytes: 5}}
+	if len(got) != len(want) {
+		t.Fatalf("got %d lines, want %d", len(got), len(want))
+	}
+	for i, e := range got {
+		if e.ID != want[i].ID || e.Bytes != want[i].Bytes || e.Size != want[i].Size {
+			t.Errorf("line %d is %+v, want %+v", i, e, want[i])
+		}
+	}
+}
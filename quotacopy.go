@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"google.golang.org/api/drive/v3"
+)
+
+// quotaCopies tracks the copies made in the user's own Drive of files whose
+// download quota is exhausted, for --copy-on-quota-block. A copy is served
+// from the user's quota instead, and is made once per download so that
+// resumed transfers reuse it.
+type quotaCopies struct {
+	// keep leaves the copies in My Drive instead of deleting them.
+	keep bool
+
+	mu  sync.Mutex
+	ids map[string]string // source file ID to copy ID
+}
+
+func newQuotaCopies(keep bool) *quotaCopies {
+	return &quotaCopies{keep: keep, ids: map[string]string{}}
+}
+
+// openCopy downloads file through a copy of it in the root of My Drive,
+// from offset onwards.
+func (d *downloader) openCopy(ctx context.Context, file *drive.File, offset int64) (*http.Response, error) {
+	copyID, err := d.quotaCopy(ctx, file)
+	if err != nil {
+		return nil, err
+	}
+	var resp *http.Response
+	err = d.retry.do(ctx, copyID, func() (err error) {
+		call := d.srv.Files.Get(copyID).Context(ctx)
+		if offset > 0 {
+			call.Header().Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		}
+		resp, err = call.Download()
+		return err
+	})
+	if isDownloadQuotaExceeded(err) {
+		return nil, errDownloadQuota
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to download copy %s: %v", copyID, err)
+	}
+	return resp, nil
+}
+
+// quotaCopy returns the ID of the copy of file, making it on first use. A
+// file is only downloaded by one goroutine at a time, so the copy is made
+// without holding the lock.
+func (d *downloader) quotaCopy(ctx context.Context, file *drive.File) (string, error) {
+	c := d.quotaCopies
+	c.mu.Lock()
+	id, ok := c.ids[file.Id]
+	c.mu.Unlock()
+	if ok {
+		return id, nil
+	}
+	var copied *drive.File
+	err := d.retry.do(ctx, file.Id, func() (err error) {
+		copied, err = d.srv.Files.Copy(file.Id, &drive.File{Name: file.Name, Parents: []string{"root"}}).
+			Fields("id").SupportsAllDrives(true).Context(ctx).Do()
+		return err
+	})
+	if err != nil {
+		return "", fmt.Errorf("download quota exhausted and unable to copy the file to My Drive: %v", err)
+	}
+	log.Printf("%s: download quota exhausted, downloading a copy made in My Drive (%s)", file.Id, copied.Id)
+	c.mu.Lock()
+	c.ids[file.Id] = copied.Id
+	c.mu.Unlock()
+	return copied.Id, nil
+}
+
+// dropQuotaCopy deletes the copy made of the file with the given ID, if
+// any, unless copies are kept. It runs even when the run is being
+// cancelled, so that no copy is left behind.
+func (d *downloader) dropQuotaCopy(ctx context.Context, fileID string) {
+	c := d.quotaCopies
+	c.mu.Lock()
+	copyID, ok := c.ids[fileID]
+	delete(c.ids, fileID)
+	c.mu.Unlock()
+	if !ok {
+		return
+	}
+	if c.keep {
+		log.Printf("%s: kept its copy %s in My Drive", fileID, copyID)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), time.Minute)
+	defer cancel()
+	err := d.retry.do(ctx, copyID, func() error {
+		return d.srv.Files.Delete(copyID).Context(ctx).Do()
+	})
+	if err != nil {
+		log.Printf("Warning: %s: unable to delete its copy %s from My Drive: %v", fileID, copyID, err)
+	}
+}
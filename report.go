@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"google.golang.org/api/drive/v3"
+)
+
+// Statuses of a file in the run report.
+const (
+	statusDownloaded = "downloaded"
+	statusSkipped    = "skipped"
+	statusFailed     = "failed"
+	statusNotStarted = "not_started" // the run stopped before getting to it
+	statusResolved   = "resolved"    // --resolve-only
+	statusVerified   = "verified"    // --verify-only, see the outcome
+	statusPlanned    = "planned"     // --dry-run, see the outcome
+
+	// statusQuota is a failure on the file's download quota, which needs
+	// waiting or a copy of the file rather than retries.
+	statusQuota = "quota_exceeded"
+)
+
+// result is the report entry of one input file.
+type result struct {
+	ID      string `json:"id"`
+	Name    string `json:"name,omitempty"`
+	Path    string `json:"path,omitempty"`
+	Status  string `json:"status"`
+	Outcome string `json:"outcome,omitempty"` // --verify-only outcome or --dry-run action
+	Bytes   int64  `json:"bytes,omitempty"`
+	Trashed bool   `json:"trashed,omitempty"`
+	Error   string `json:"error,omitempty"`
+
+	// file is the file's metadata, when it was fetched, for the catalog.
+	file *drive.File
+}
+
+// report collects per-file results for the --report and --catalog files.
+type report struct {
+	mu      sync.Mutex
+	results []*result
+}
+
+func (r *report) add(res *result) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.results = append(r.results, res)
+}
+
+// runReport is the document written to --report.
+type runReport struct {
+	// Complete is false when the run stopped early or any file failed, so a
+	// scheduled job knows there is more to pick up.
+	Complete bool      `json:"complete"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	Summary  struct {
+		Downloaded int64 `json:"downloaded"`
+		Skipped    int64 `json:"skipped"`
+		Failed     int64 `json:"failed"`
+		Bytes      int64 `json:"bytes"`
+	} `json:"summary"`
+	Files []*result `json:"files"`
+}
+
+// write saves the report to path.
+func (r *report) write(path string, s *stats, complete bool) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	doc := runReport{Complete: complete, Started: s.start, Finished: time.Now(), Files: r.results}
+	doc.Summary.Downloaded = s.completed.Load()
+	doc.Summary.Skipped = s.skipped.Load()
+	doc.Summary.Failed = s.failed.Load()
+	doc.Summary.Bytes = s.bytes.Load()
+	if doc.Files == nil {
+		doc.Files = []*result{}
+	}
+
+	b, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return fmt.Errorf("unable to encode report: %v", err)
+	}
+	if err := os.WriteFile(path, append(b, '\n'), 0644); err != nil {
+		return fmt.Errorf("unable to write report: %v", err)
+	}
+	return nil
+}
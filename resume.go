@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"google.golang.org/api/drive/v3"
+)
+
+// resumingReader reads the body of a download, and when the stream breaks
+// part way, typically on a connection reset or because the short-lived media
+// link expired on a long transfer, requests the rest of the file from the
+// last byte read and carries on. To the copy loop a flaky connection is just
+// a slower read.
+//
+// Only failures in a row without any progress count against maxRetries, and
+// each is preceded by a backoff and takes from the retry budget.
+type resumingReader struct {
+	ctx  context.Context
+	d    *downloader
+	file *drive.File
+	body io.ReadCloser
+	// read is the number of bytes of the file read so far.
+	read     int64
+	failures int
+	// restart, if set, starts the output over for a source that cannot
+	// be read from an offset, such as an export. Without it a broken export
+	// fails the download.
+	restart func() error
+}
+
+func (d *downloader) resumable(ctx context.Context, file *drive.File, resp *http.Response) *resumingReader {
+	return &resumingReader{ctx: ctx, d: d, file: file, body: resp.Body}
+}
+
+func (r *resumingReader) Read(p []byte) (int, error) {
+	for {
+		n, err := r.body.Read(p)
+		r.read += int64(n)
+		if n > 0 {
+			r.failures = 0
+		}
+		if err == nil || err == io.EOF {
+			return n, err
+		}
+		if err := r.resume(err); err != nil {
+			return n, err
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+// Close closes the current body.
+func (r *resumingReader) Close() error {
+	return r.body.Close()
+}
+
+// resume replaces the broken body with one starting at the next byte, or
+// returns cause if the download cannot go on.
+func (r *resumingReader) resume(cause error) error {
+	retries := r.d.retry.maxRetries
+	if r.ctx.Err() != nil || r.failures >= retries {
+		return cause
+	}
+	if r.d.retry.budget != nil && !r.d.retry.budget.take() {
+		return cause
+	}
+	r.failures++
+	delay := backoff(r.failures - 1)
+	r.d.retry.log.record(r.file.Id, r.failures, retries, causeTransfer, cause, delay)
+	log.Printf("%s: transfer interrupted after %s (%v), resuming in %v (%d/%d)", r.file.Id, logBytes(r.read), cause, delay, r.failures, retries)
+	select {
+	case <-r.ctx.Done():
+		return r.ctx.Err()
+	case <-time.After(delay):
+	}
+
+	r.body.Close()
+	resp, err := r.d.openContent(r.ctx, r.file, r.read)
+	if err != nil {
+		r.body = http.NoBody
+		return err
+	}
+	r.body = resp.Body
+	if resp.StatusCode == http.StatusPartialContent {
+		return nil
+	}
+	// The range was ignored and the whole file is coming again.
+	if !isNative(r.file) {
+		// Stored content does not change, so what was read already can
+		// be skipped.
+		if _, err := io.CopyN(io.Discard, resp.Body, r.read); err != nil {
+			return fmt.Errorf("unable to skip to byte %d of the new download: %v", r.read, err)
+		}
+		return nil
+	}
+	if r.restart == nil {
+		return cause
+	}
+	r.read = 0
+	return r.restart()
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+// Backoff bounds between retry attempts.
+const (
+	retryBaseDelay = time.Second
+	retryMaxDelay  = 32 * time.Second
+)
+
+// retrier re-runs API calls that fail with transient errors, backing off
+// exponentially between attempts. A zero maxRetries disables retrying.
+type retrier struct {
+	maxRetries int
+	// budget, if set, caps the retries of all calls together.
+	budget *retryBudget
+	// retryable, if set, decides which errors are retried instead of
+	// isRetryable. It may call isRetryable to extend the default rather
+	// than replace it.
+	retryable func(error) bool
+	// log, if set, records every retry for --retry-log.
+	log *retryLog
+}
+
+// retryBudget is a token bucket of retries shared by every call, refilling
+// at perMinute a minute up to perMinute. During a Google side incident it
+// keeps all the files from retrying at once: once it is empty, failures are
+// returned straight away until it refills.
+type retryBudget struct {
+	perMinute int
+
+	mu      sync.Mutex
+	tokens  float64
+	last    time.Time
+	tripped bool
+}
+
+func newRetryBudget(perMinute int) *retryBudget {
+	return &retryBudget{perMinute: perMinute, tokens: float64(perMinute), last: time.Now()}
+}
+
+// take spends a retry, reporting whether there was one left.
+func (b *retryBudget) take() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	b.tokens = min(float64(b.perMinute), b.tokens+now.Sub(b.last).Minutes()*float64(b.perMinute))
+	b.last = now
+	if b.tokens < 1 {
+		if !b.tripped {
+			log.Printf("Retry budget of %d per minute exhausted, failing without retrying until it refills", b.perMinute)
+			b.tripped = true
+		}
+		return false
+	}
+	if b.tripped {
+		log.Print("Retry budget refilled, retrying again")
+		b.tripped = false
+	}
+	b.tokens--
+	return true
+}
+
+// do runs fn until it succeeds, fails permanently or runs out of attempts.
+// The label identifies the operation in log lines.
+func (r *retrier) do(ctx context.Context, label string, fn func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || !r.shouldRetry(err) {
+			return err
+		}
+		pending := isPending(err)
+		if attempt >= r.maxRetries {
+			if pending && r.maxRetries > 0 {
+				log.Printf("%s: still not ready after %d retries, giving up", label, r.maxRetries)
+			}
+			return err
+		}
+		if r.budget != nil && !r.budget.take() {
+			return err
+		}
+
+		delay := backoff(attempt)
+		r.log.record(label, attempt+1, r.maxRetries, retryCause(err), err, delay)
+		if pending {
+			log.Printf("%s: file is not ready yet (still being processed), retrying in %v (%d/%d)", label, delay, attempt+1, r.maxRetries)
+		} else {
+			log.Printf("%s: %v, retrying in %v (%d/%d)", label, err, delay, attempt+1, r.maxRetries)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// shouldRetry applies the retryable hook, or the default classification.
+func (r *retrier) shouldRetry(err error) bool {
+	if r.retryable != nil {
+		return r.retryable(err)
+	}
+	return isRetryable(err)
+}
+
+// retryOnStatus returns a retryable hook that also retries API errors with
+// any of the given HTTP status codes, for --retry-on-status. Exhausted
+// download quotas and files flagged as abusive still are not retried, even
+// when their 403 is listed.
+func retryOnStatus(codes []int) func(error) bool {
+	return func(err error) bool {
+		if isRetryable(err) {
+			return true
+		}
+		if isDownloadQuotaExceeded(err) || isAbusiveFile(err) {
+			return false
+		}
+		var apiErr *googleapi.Error
+		return errors.As(err, &apiErr) && slices.Contains(codes, apiErr.Code)
+	}
+}
+
+// parseStatusCodes parses a comma separated list of HTTP status codes.
+func parseStatusCodes(s string) ([]int, error) {
+	var codes []int
+	for _, v := range strings.Split(s, ",") {
+		code, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil || code < 100 || code > 599 {
+			return nil, fmt.Errorf("invalid --retry-on-status %q, expected HTTP status codes such as 408,502", s)
+		}
+		codes = append(codes, code)
+	}
+	return codes, nil
+}
+
+// backoff returns the jittered delay before the given retry attempt.
+func backoff(attempt int) time.Duration {
+	d := retryBaseDelay << attempt
+	if d > retryMaxDelay || d <= 0 {
+		d = retryMaxDelay
+	}
+	return d/2 + rand.N(d/2)
+}
+
+// isRetryable is the default classification of the errors worth another
+// attempt:
+//   - 429 Too Many Requests, and 403s with the rateLimitExceeded or
+//     userRateLimitExceeded reason;
+//   - any 5xx server side failure;
+//   - files that are still being processed (see isPending).
+//
+// A file's exhausted download quota is never retried, and neither is any
+// error that is not a Drive API error, such as network failures, which
+// the HTTP client and resumed transfers handle instead.
+func isRetryable(err error) bool {
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	switch {
+	case hasReason(apiErr, "downloadQuotaExceeded"):
+		return false
+	case apiErr.Code == http.StatusTooManyRequests, apiErr.Code >= 500:
+		return true
+	case hasReason(apiErr, "rateLimitExceeded", "userRateLimitExceeded"):
+		return true
+	}
+	return isPending(err)
+}
+
+// errDownloadQuota is returned for a file that has been downloaded too
+// often, typically a popular public file. Unlike API rate limits it lasts
+// hours, so retrying does not help.
+var errDownloadQuota = errors.New("the file's download quota is exhausted; try again later, or make a copy in your own Drive and download that")
+
+// isDownloadQuotaExceeded reports whether err is Drive refusing a download
+// because of the file's download quota.
+func isDownloadQuotaExceeded(err error) bool {
+	var apiErr *googleapi.Error
+	return errors.As(err, &apiErr) && hasReason(apiErr, "downloadQuotaExceeded")
+}
+
+// errAbusiveFile is returned for a file Drive flagged as malware or spam,
+// which it only serves once the risk is acknowledged.
+var errAbusiveFile = errors.New("Drive flagged the file as malware or spam and blocks downloading it; pass --acknowledge-abuse to download it anyway")
+
+// isAbusiveFile reports whether err is Drive refusing a download because
+// it flagged the file as abusive.
+func isAbusiveFile(err error) bool {
+	var apiErr *googleapi.Error
+	return errors.As(err, &apiErr) && hasReason(apiErr, "cannotDownloadAbusiveFile")
+}
+
+// isPending reports whether err says the file is not ready to be served yet,
+// which happens right after an upload while Drive is still processing it.
+func isPending(err error) bool {
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	if apiErr.Code == http.StatusConflict || apiErr.Code == http.StatusTooEarly {
+		return true
+	}
+	msg := strings.ToLower(apiErr.Message)
+	return strings.Contains(msg, "not ready") || strings.Contains(msg, "being processed")
+}
+
+// hasReason reports whether any of the error items carries one of reasons.
+func hasReason(apiErr *googleapi.Error, reasons ...string) bool {
+	for _, item := range apiErr.Errors {
+		for _, r := range reasons {
+			if item.Reason == r {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+// Causes of a retry in the --retry-log.
+const (
+	causeRateLimit = "rate_limit"
+	causeServer    = "server_error"
+	causePending   = "pending"
+	causeTransfer  = "transfer"
+	causeOther     = "other"
+)
+
+// retryLog appends a JSON line to --retry-log for every retry attempt, so
+// the failure patterns of a flaky run can be looked at afterwards.
+type retryLog struct {
+	mu  sync.Mutex
+	f   *os.File
+	enc *json.Encoder
+}
+
+// retryEntry is one line of the --retry-log. ID is the file ID, or the
+// listing query for folder pages.
+type retryEntry struct {
+	Time    time.Time `json:"time"`
+	ID      string    `json:"id"`
+	Attempt int       `json:"attempt"`
+	Max     int       `json:"max_retries"`
+	Cause   string    `json:"cause"`
+	Status  int       `json:"status,omitempty"`
+	Reason  string    `json:"reason,omitempty"`
+	Error   string    `json:"error"`
+	DelayMS int64     `json:"delay_ms"`
+}
+
+func openRetryLog(path string) (*retryLog, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open retry log: %v", err)
+	}
+	return &retryLog{f: f, enc: json.NewEncoder(f)}, nil
+}
+
+// record writes a retry of id after err, waiting delay before attempt. A
+// nil retryLog records nothing.
+func (l *retryLog) record(id string, attempt, max int, cause string, err error, delay time.Duration) {
+	if l == nil {
+		return
+	}
+	e := retryEntry{
+		Time:    time.Now().UTC(),
+		ID:      id,
+		Attempt: attempt,
+		Max:     max,
+		Cause:   cause,
+		Error:   err.Error(),
+		DelayMS: delay.Milliseconds(),
+	}
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		e.Status = apiErr.Code
+		if len(apiErr.Errors) > 0 {
+			e.Reason = apiErr.Errors[0].Reason
+		}
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.enc.Encode(e)
+}
+
+func (l *retryLog) Close() error {
+	return l.f.Close()
+}
+
+// retryCause classifies an API error being retried for the --retry-log.
+func retryCause(err error) string {
+	if isPending(err) {
+		return causePending
+	}
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) {
+		return causeOther
+	}
+	switch {
+	case apiErr.Code == http.StatusTooManyRequests, hasReason(apiErr, "rateLimitExceeded", "userRateLimitExceeded"):
+		return causeRateLimit
+	case apiErr.Code >= 500:
+		return causeServer
+	}
+	return causeOther
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"google.golang.org/api/drive/v3"
+)
+
+// saveRevisions downloads up to n of the revisions before the current
+// content of file, saved at path, for --revisions. Each goes next to the
+// file as <name>.rev<time><ext>, after the time the revision was made, so
+// its name stays the same from one run to the next even once Drive prunes
+// older revisions. Files with a shorter history get what there is.
+func (d *downloader) saveRevisions(ctx context.Context, file *drive.File, path string, n int) error {
+	var revs []*drive.Revision
+	err := d.retry.do(ctx, file.Id, func() error {
+		revs = nil
+		return d.srv.Revisions.List(file.Id).PageSize(200).Fields("nextPageToken,revisions(id,modifiedTime)").
+			Pages(ctx, func(list *drive.RevisionList) error {
+				revs = append(revs, list.Revisions...)
+				return nil
+			})
+	})
+	if err != nil {
+		return fmt.Errorf("unable to list revisions: %v", err)
+	}
+	// The last revision is the current content, downloaded already.
+	older := max(len(revs)-1, 0)
+	for i := max(older-n, 0); i < older; i++ {
+		dest := revisionPath(path, revs[i])
+		if err := d.saveRevision(ctx, file.Id, revs[i].Id, dest); err != nil {
+			return fmt.Errorf("revision %s: %v", revs[i].Id, err)
+		}
+		d.mirror.keepPath(dest)
+		log.Printf("%s: saved revision %s of %s to %s", file.Id, revs[i].Id, revs[i].ModifiedTime, dest)
+	}
+	return nil
+}
+
+// revisionTimeLayout is the modified time in revision file names, in UTC.
+const revisionTimeLayout = "20060102T150405Z"
+
+// revisionPath inserts .rev<time> before the extension of path, the time
+// rev was made. A revision without a readable time goes by its ID instead.
+func revisionPath(path string, rev *drive.Revision) string {
+	stamp := rev.Id
+	if t, err := time.Parse(time.RFC3339, rev.ModifiedTime); err == nil {
+		stamp = t.UTC().Format(revisionTimeLayout)
+	}
+	ext := filepath.Ext(path)
+	return fmt.Sprintf("%s.rev%s%s", strings.TrimSuffix(path, ext), stamp, ext)
+}
+
+// revisionOf returns the path of the file a revision file, named by
+// revisionPath, belongs to.
+func revisionOf(path string) (string, bool) {
+	i := strings.LastIndex(path, ".rev")
+	if i < 0 {
+		return "", false
+	}
+	stamp, ext, hasExt := strings.Cut(path[i+len(".rev"):], ".")
+	if stamp == "" || strings.ContainsAny(stamp+ext, `./\`) {
+		return "", false
+	}
+	if hasExt {
+		ext = "." + ext
+	}
+	return path[:i] + ext, true
+}
+
+// saveRevision downloads a single revision to dest, leaving nothing behind
+// on failure.
+func (d *downloader) saveRevision(ctx context.Context, fileID, revID, dest string) error {
+	var resp *http.Response
+	err := d.retry.do(ctx, fileID, func() (err error) {
+		resp, err = d.srv.Revisions.Get(fileID, revID).Context(ctx).Download()
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("unable to download revision: %v", err)
+	}
+	defer resp.Body.Close()
+	out, err := d.create(dest)
+	if err != nil {
+		return fmt.Errorf("unable to create revision file: %v", err)
+	}
+	if _, err := io.Copy(out, resp.Body); err != nil {
+		out.Close()
+		os.Remove(dest)
+		return fmt.Errorf("unable to write revision: %v", err)
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(dest)
+		return fmt.Errorf("unable to write revision: %v", err)
+	}
+	return nil
+}
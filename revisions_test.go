@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestRevisionNamesAreStable(t *testing.T) {
+	t.Chdir(t.TempDir())
+	fd := newFakeDrive(t)
+	seedFixtures(fd)
+	fd.addRevision("small", "r1", "2024-01-01T10:00:00.000Z", []byte("first\n"))
+	fd.addRevision("small", "r2", "2024-01-01T11:30:00.000Z", []byte("second\n"))
+	fd.addRevision("small", "r3", "2024-01-02T03:04:05.000Z", []byte("hello, drive\n"))
+
+	d := fd.downloader(t)
+	ctx := context.Background()
+	file, err := d.metadata(ctx, "small")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join("A", "B", "small.txt")
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	second := filepath.Join("A", "B", "small.rev20240101T113000Z.txt")
+	if err := d.saveRevisions(ctx, file, path, 5); err != nil {
+		t.Fatal(err)
+	}
+	checkContent(t, filepath.Join("A", "B", "small.rev20240101T100000Z.txt"), []byte("first\n"))
+	checkContent(t, second, []byte("second\n"))
+
+	// Once the oldest revision is gone, the others keep their names.
+	fd.pruneRevision("small")
+	if err := os.RemoveAll("A"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.saveRevisions(ctx, file, path, 5); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	if want := []string{filepath.Base(second)}; !slices.Equal(names, want) {
+		t.Errorf("saved %v, want %v", names, want)
+	}
+	checkContent(t, second, []byte("second\n"))
+}
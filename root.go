@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
+)
+
+// rootKeyword, given as input, stands for the My Drive root folder. Drive
+// accepts it as an alias of the folder's ID, so with --recursive it is
+// walked like any other folder.
+const rootKeyword = "root"
+
+// listRoot submits the files directly in the My Drive root, for the root
+// keyword given without --recursive. Subfolders are left out, as they would
+// need --recursive anyway.
+func (p *pipeline) listRoot(ctx context.Context, rootID string) error {
+	query := fmt.Sprintf("'%s' in parents and trashed = false", rootID)
+	fields := googleapi.Field("nextPageToken,files(" + string(p.d.fileFields()) + ")")
+	var token string
+	folders := 0
+	for {
+		if err := p.metaSem.Acquire(p.start, 1); err != nil {
+			return err
+		}
+		var list *drive.FileList
+		err := p.d.retry.do(ctx, query, func() (err error) {
+			list, err = p.d.list(query).Fields(fields).PageToken(token).Context(ctx).Do()
+			return err
+		})
+		p.metaSem.Release(1)
+		if err != nil {
+			return fmt.Errorf("unable to list My Drive: %v", err)
+		}
+		for _, f := range list.Files {
+			if f.MimeType == folderMimeType {
+				folders++
+				continue
+			}
+			p.submit(ctx, inputEntry{id: f.Id, file: f, parent: rootID}, nil)
+		}
+		if token = list.NextPageToken; token == "" {
+			break
+		}
+	}
+	if folders > 0 {
+		log.Printf("Skipped %d folders in My Drive, use --recursive to download their contents", folders)
+	}
+	return nil
+}
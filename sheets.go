@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/sheets/v4"
+)
+
+// spreadsheetMimeType is the type --sheets-per-tab splits into CSV files.
+const spreadsheetMimeType = "application/vnd.google-apps.spreadsheet"
+
+// saveSheetTabs exports every tab of a spreadsheet to <name>/<tab>.csv,
+// where dest is the path the whole spreadsheet would have been exported to.
+// Files.Export only ever gives the first tab as CSV, so the tabs are listed
+// with the Sheets API and each one is fetched from the spreadsheet's
+// gid-based export URL.
+//
+// The Sheets API accepts the drive.readonly scope, so no extra scope is
+// needed, but it must be enabled for the OAuth client's Cloud project.
+func (d *downloader) saveSheetTabs(ctx context.Context, file *drive.File, dest string) (saved, error) {
+	dir := sheetTabsDir(dest)
+	var sheet *sheets.Spreadsheet
+	err := d.retry.do(ctx, file.Id, func() (err error) {
+		sheet, err = d.sheets.Spreadsheets.Get(file.Id).Fields("sheets.properties(sheetId,title)").Context(ctx).Do()
+		return err
+	})
+	if err != nil {
+		return saved{}, fmt.Errorf("unable to list the spreadsheet's tabs: %v", err)
+	}
+	// makeParentDirs creates the folders above a path, so going through a
+	// placeholder name creates dir itself, handling conflicts as for any
+	// folder.
+	dir, err = d.makeParentDirs(filepath.Join(dir, "tab"))
+	if err != nil {
+		return saved{}, err
+	}
+	dir = filepath.Dir(dir)
+
+	res := saved{path: dir}
+	t := d.stats.begin(file, dir)
+	t.progress = d.progress
+	defer d.stats.end(t)
+	for _, s := range sheet.Sheets {
+		name := strings.ReplaceAll(s.Properties.Title, string(filepath.Separator), "_") + ".csv"
+		tab := d.normalize(filepath.Join(dir, name))
+		link := fmt.Sprintf("https://docs.google.com/spreadsheets/d/%s/export?format=csv&gid=%d", url.PathEscape(file.Id), s.Properties.SheetId)
+		n, err := d.fetchTab(ctx, file, link, tab, t)
+		if err != nil {
+			return res, fmt.Errorf("unable to export tab %q: %v", s.Properties.Title, err)
+		}
+		d.mirror.keepPath(tab)
+		res.bytes += n
+	}
+	d.stats.completed.Add(1)
+	return res, nil
+}
+
+// sheetTabsDir is the folder the tabs of a spreadsheet resolved to dest are
+// written to, before any --on-dir-conflict rename.
+func sheetTabsDir(dest string) string {
+	return strings.TrimSuffix(dest, filepath.Ext(dest))
+}
+
+// fetchTab writes one tab's CSV export to path.
+func (d *downloader) fetchTab(ctx context.Context, file *drive.File, link, path string, t *transfer) (int64, error) {
+	resp, err := d.fetchExportLink(ctx, file, link)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	out, err := d.create(path)
+	if err != nil {
+		return 0, diskErrorf(err, "unable to create download file: %v", err)
+	}
+	buf := d.buffers.Get().(*[]byte)
+	defer d.buffers.Put(buf)
+	n, err := io.CopyBuffer(countingWriter{out, t}, resp.Body, *buf)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path)
+		return 0, diskErrorf(err, "unable to write file content: %v", err)
+	}
+	return n, nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+
+	"google.golang.org/api/drive/v3"
+)
+
+// validateFields checks that each --include-field selector starts with a
+// field of the Drive File resource. Sub-selections such as
+// "imageMediaMetadata(width,height)" are passed through as they are.
+func validateFields(fields []string) error {
+	known := map[string]bool{}
+	t := reflect.TypeOf(drive.File{})
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name != "" && name != "-" {
+			known[name] = true
+		}
+	}
+	for _, f := range fields {
+		top := strings.FieldsFunc(f, func(r rune) bool { return r == '(' || r == '/' })
+		if len(top) == 0 || !known[top[0]] {
+			return fmt.Errorf("%q is not a Drive file field", f)
+		}
+	}
+	return nil
+}
+
+// metadataSidecarExt is appended to a download's path for its
+// --include-field metadata.
+const metadataSidecarExt = ".metadata.json"
+
+// writeMetadataSidecar saves the file's metadata, including any
+// --include-field values, to path as JSON.
+func (d *downloader) writeMetadataSidecar(file *drive.File, path string) error {
+	b, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return fmt.Errorf("unable to encode metadata: %v", err)
+	}
+	if err := os.WriteFile(path, append(b, '\n'), d.newFileMode); err != nil {
+		return fmt.Errorf("unable to write metadata file: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"google.golang.org/api/drive/v3"
+)
+
+// parseModifiedAfter parses --modified-after, an RFC 3339 time or a date
+// such as 2024-05-01 (midnight UTC).
+func parseModifiedAfter(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(time.DateOnly, s); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid --modified-after %q, expected a date such as 2024-05-01 or a time such as 2024-05-01T12:00:00Z", s)
+}
+
+// unchangedSince reports whether file was last modified before
+// --modified-after or the last run, and is not to be downloaded. Folders
+// are always walked, as their modification time says nothing about their
+// contents.
+func (d *downloader) unchangedSince(file *drive.File) bool {
+	if d.modifiedAfter.IsZero() || file.MimeType == folderMimeType {
+		return false
+	}
+	modified, err := time.Parse(time.RFC3339, file.ModifiedTime)
+	return err == nil && !modified.After(d.modifiedAfter)
+}
+
+// lastRun is the --since-last-run state file.
+type lastRun struct {
+	// Started is when the last run that recorded itself started, so that
+	// files changed while it was running are picked up by the next one.
+	Started time.Time `json:"started"`
+}
+
+// loadLastRun returns the start time recorded in path, and false on the
+// first run, when there is none yet.
+func loadLastRun(path string) (time.Time, bool, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return time.Time{}, false, nil
+	}
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("unable to read last run file: %v", err)
+	}
+	var run lastRun
+	if err := json.Unmarshal(b, &run); err != nil || run.Started.IsZero() {
+		return time.Time{}, false, fmt.Errorf("invalid last run file %s, remove it to download everything again", path)
+	}
+	return run.Started, true, nil
+}
+
+// saveLastRun records started in path, replacing it in one rename so an
+// interrupted write never leaves a broken file behind.
+func saveLastRun(path string, started time.Time) error {
+	b, err := json.MarshalIndent(lastRun{Started: started.UTC()}, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".gdrive-dl-last-run-*")
+	if err != nil {
+		return fmt.Errorf("unable to write last run file: %v", err)
+	}
+	if _, err := tmp.Write(append(b, '\n')); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("unable to write last run file: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("unable to write last run file: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("unable to write last run file: %v", err)
+	}
+	return nil
+}
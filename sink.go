@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/drive/v3"
+)
+
+// sink is where --sink writes downloads instead of the local output tree.
+// Paths are the usual output paths, slash separated.
+type sink interface {
+	// Create starts writing the content of path.
+	Create(ctx context.Context, path string) (sinkWriter, error)
+	// Stat reports the size of path and whether it exists.
+	Stat(ctx context.Context, path string) (size int64, ok bool, err error)
+}
+
+// sinkWriter is the content of one file being written to a sink. Close
+// commits it, while Abort discards whatever was written, so a failed
+// download never shows up in the sink.
+type sinkWriter interface {
+	io.WriteCloser
+	Abort(err error)
+}
+
+// gcsScope lets the sink write objects to Cloud Storage.
+const gcsScope = "https://www.googleapis.com/auth/devstorage.read_write"
+
+// openSink opens the sink of a --sink URL: gs://bucket/prefix for Cloud
+// Storage, with the application default credentials, or file://dir for a
+// local directory, whose files and folders get fileMode and dirMode.
+func openSink(ctx context.Context, rawURL string, fileMode, dirMode os.FileMode) (sink, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --sink %q: %v", rawURL, err)
+	}
+	switch u.Scheme {
+	case "gs":
+		if u.Host == "" {
+			return nil, fmt.Errorf("invalid --sink %q, expected gs://bucket/prefix", rawURL)
+		}
+		client, err := google.DefaultClient(ctx, gcsScope)
+		if err != nil {
+			return nil, fmt.Errorf("unable to find Cloud Storage credentials: %v", err)
+		}
+		return &gcsSink{client: client, bucket: u.Host, prefix: strings.Trim(u.Path, "/")}, nil
+	case "file":
+		dir := u.Host + u.Path
+		if dir == "" {
+			return nil, fmt.Errorf("invalid --sink %q, expected file://dir", rawURL)
+		}
+		return localSink{dir: dir, fileMode: fileMode, dirMode: dirMode}, nil
+	case "s3":
+		return nil, fmt.Errorf("--sink %q: S3 is not supported yet, only gs:// and file://", rawURL)
+	}
+	return nil, fmt.Errorf("invalid --sink %q, expected a gs:// or file:// URL", rawURL)
+}
+
+// saveToSink streams file into the sink at dest. Size and md5 checks run
+// on the bytes as they go by, and a file failing them is aborted rather
+// than committed.
+func (d *downloader) saveToSink(ctx context.Context, file *drive.File, dest string) (saved, error) {
+	res := saved{path: dest}
+	if d.skipExisting {
+		size, ok, err := d.sink.Stat(ctx, filepath.ToSlash(dest))
+		if err != nil {
+			return res, err
+		}
+		if ok && (d.skipMatch == skipMatchExists || (!isNative(file) && size == file.Size)) {
+			log.Printf("%s: %s already exists, skipping", file.Id, dest)
+			d.stats.skipped.Add(1)
+			res.skipped = true
+			return res, nil
+		}
+	}
+
+	t := d.stats.begin(file, dest)
+	t.progress = d.progress
+	defer d.stats.end(t)
+	for attempt := 0; ; attempt++ {
+		w, written, sum, err := d.fetchToSink(ctx, file, dest, t)
+		if err != nil {
+			return res, err
+		}
+		err = d.checkSize(file, dest, written)
+		if err == nil && d.verifyMD5 && !isNative(file) && file.Md5Checksum != "" && sum != file.Md5Checksum {
+			err = &checksumError{got: sum, want: file.Md5Checksum}
+		}
+		if err == nil {
+			if err := w.Close(); err != nil {
+				return res, err
+			}
+			d.stats.completed.Add(1)
+			res.bytes = written
+			if d.trashAfter {
+				res.trashed, err = d.trash(ctx, file, dest, written)
+			}
+			return res, err
+		}
+		w.Abort(err)
+		retries := d.redownloads(err)
+		if attempt >= retries {
+			return res, err
+		}
+		log.Printf("%s: %v, downloading again (%d/%d)", file.Id, err, attempt+1, retries)
+	}
+}
+
+// fetchToSink writes one attempt at file into the sink, returning the
+// writer to commit or abort once the content is checked, the number of
+// bytes read from Drive and the md5 of what was written. Nothing is left in
+// the sink on failure.
+func (d *downloader) fetchToSink(ctx context.Context, file *drive.File, dest string, t *transfer) (sinkWriter, int64, string, error) {
+	if d.quotaCopies != nil {
+		defer d.dropQuotaCopy(ctx, file.Id)
+	}
+	src, err := d.stream(ctx, file)
+	if err != nil {
+		return nil, 0, "", err
+	}
+	defer src.Close()
+	w, err := d.sink.Create(ctx, filepath.ToSlash(dest))
+	if err != nil {
+		return nil, 0, "", err
+	}
+	t.reset()
+	h := md5.New()
+	out := io.MultiWriter(w, h)
+	var written int64
+	if d.gunzip || d.gzip {
+		written, err = d.copyTransformed(ctx, file, out, src, t)
+	} else {
+		buf := d.buffers.Get().(*[]byte)
+		_, err = io.CopyBuffer(countingWriter{out, t}, src, *buf)
+		d.buffers.Put(buf)
+		written = src.read
+	}
+	if err != nil {
+		w.Abort(err)
+		if errors.Is(err, errNotGzip) {
+			return nil, 0, "", err
+		}
+		return nil, 0, "", fmt.Errorf("unable to write file content: %v", err)
+	}
+	return w, written, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// localSink writes under a local directory. Each file is written to a
+// temporary file next to it and renamed into place on Close.
+type localSink struct {
+	dir      string
+	fileMode os.FileMode
+	dirMode  os.FileMode
+}
+
+func (s localSink) Create(ctx context.Context, name string) (sinkWriter, error) {
+	dest := filepath.Join(s.dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(dest), s.dirMode); err != nil {
+		return nil, fmt.Errorf("unable to create folder: %v", err)
+	}
+	// Unlike os.CreateTemp, which makes the file private to the user, this
+	// gives it --file-mode with the umask applied, as for other downloads.
+	for {
+		tmp := filepath.Join(filepath.Dir(dest), fmt.Sprintf(".gdrive-dl-%016x", rand.Uint64()))
+		f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_EXCL, s.fileMode)
+		if errors.Is(err, os.ErrExist) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to create download file: %v", err)
+		}
+		return &localWriter{File: f, dest: dest}, nil
+	}
+}
+
+func (s localSink) Stat(ctx context.Context, name string) (int64, bool, error) {
+	info, err := os.Stat(filepath.Join(s.dir, filepath.FromSlash(name)))
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return info.Size(), info.Mode().IsRegular(), nil
+}
+
+type localWriter struct {
+	*os.File
+	dest string
+}
+
+func (w *localWriter) Close() error {
+	if err := w.File.Close(); err != nil {
+		os.Remove(w.Name())
+		return fmt.Errorf("unable to write file content: %v", err)
+	}
+	if err := os.Rename(w.Name(), w.dest); err != nil {
+		os.Remove(w.Name())
+		return fmt.Errorf("unable to move download into place: %v", err)
+	}
+	return nil
+}
+
+func (w *localWriter) Abort(error) {
+	w.File.Close()
+	os.Remove(w.Name())
+}
+
+// gcsSink writes objects to a Cloud Storage bucket under prefix, streaming
+// each one in a single upload request so nothing is staged locally.
+type gcsSink struct {
+	client *http.Client
+	bucket string
+	prefix string
+}
+
+func (s *gcsSink) object(name string) string {
+	return path.Join(s.prefix, name)
+}
+
+func (s *gcsSink) Create(ctx context.Context, name string) (sinkWriter, error) {
+	pr, pw := io.Pipe()
+	u := fmt.Sprintf("https://storage.googleapis.com/upload/storage/v1/b/%s/o?uploadType=media&name=%s",
+		url.PathEscape(s.bucket), url.QueryEscape(s.object(name)))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, pr)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	w := &gcsWriter{pw: pw, done: make(chan error, 1)}
+	go func() {
+		resp, err := s.client.Do(req)
+		if err == nil {
+			err = uploadError(resp)
+		}
+		// Unblock the writer if the request ended early.
+		pr.CloseWithError(fmt.Errorf("upload ended: %v", err))
+		w.done <- err
+	}()
+	return w, nil
+}
+
+func (s *gcsSink) Stat(ctx context.Context, name string) (int64, bool, error) {
+	u := fmt.Sprintf("https://storage.googleapis.com/storage/v1/b/%s/o/%s?fields=size",
+		url.PathEscape(s.bucket), url.PathEscape(s.object(name)))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return 0, false, err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, false, fmt.Errorf("unable to look up object: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return 0, false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, false, fmt.Errorf("unable to look up object: %s", resp.Status)
+	}
+	var meta struct {
+		Size int64 `json:"size,string"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&meta); err != nil {
+		return 0, false, fmt.Errorf("unable to look up object: %v", err)
+	}
+	return meta.Size, true, nil
+}
+
+// uploadError returns the failure of an upload response, if any, and
+// closes its body.
+func uploadError(resp *http.Response) error {
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(b)))
+}
+
+type gcsWriter struct {
+	pw   *io.PipeWriter
+	done chan error
+}
+
+func (w *gcsWriter) Write(p []byte) (int, error) {
+	return w.pw.Write(p)
+}
+
+// Close ends the upload, which only then creates the object.
+func (w *gcsWriter) Close() error {
+	w.pw.Close()
+	if err := <-w.done; err != nil {
+		return fmt.Errorf("unable to upload object: %v", err)
+	}
+	return nil
+}
+
+// Abort fails the upload's request body, so the object is never created.
+func (w *gcsWriter) Abort(err error) {
+	w.pw.CloseWithError(err)
+	<-w.done
+}
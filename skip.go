@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"google.golang.org/api/drive/v3"
+)
+
+// Ways --skip-existing decides a file is already present.
+const (
+	skipMatchExists   = "exists"
+	skipMatchNameSize = "name-size"
+	skipMatchChecksum = "checksum"
+)
+
+// parseSkipMatch validates a --skip-match value.
+func parseSkipMatch(match string) (string, error) {
+	switch match {
+	case skipMatchExists, skipMatchNameSize, skipMatchChecksum:
+		return match, nil
+	}
+	return "", fmt.Errorf("unknown --skip-match %q, expected exists, name-size or checksum", match)
+}
+
+// What --on-empty-file does with files that are empty on Drive.
+const (
+	onEmptyDownload = "download"
+	onEmptySkip     = "skip"
+	onEmptyWarnFile = "warn"
+)
+
+func parseOnEmptyFile(s string) (string, error) {
+	switch s {
+	case onEmptyDownload, onEmptySkip, onEmptyWarnFile:
+		return s, nil
+	}
+	return "", fmt.Errorf("invalid --on-empty-file %q, expected %s, %s or %s", s, onEmptyDownload, onEmptySkip, onEmptyWarnFile)
+}
+
+// isEmptyFile reports whether file holds no bytes on Drive. Exports have no
+// size, so they never are.
+func isEmptyFile(file *drive.File) bool {
+	return !isNative(file) && file.Size == 0
+}
+
+// alreadyPresent reports whether dest already holds file according to the
+// skip-match mode. Exported files have no size on Drive, so name-size never
+// considers them present and they are exported again. With checksum they
+// are present when the local copy was written after their last change.
+func (d *downloader) alreadyPresent(file *drive.File, dest string) bool {
+	info, err := os.Stat(dest)
+	if err != nil || !info.Mode().IsRegular() {
+		return false
+	}
+	switch d.skipMatch {
+	case skipMatchNameSize:
+		return !isNative(file) && info.Size() == file.Size
+	case skipMatchChecksum:
+		if isNative(file) {
+			modified, err := time.Parse(time.RFC3339, file.ModifiedTime)
+			return err == nil && !info.ModTime().Before(modified)
+		}
+		outcome, err := verifyLocal(file, dest)
+		return err == nil && outcome == verifyOK
+	default:
+		return true
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"google.golang.org/api/drive/v3"
+)
+
+// driveAppDataScope is needed on top of the read scope to list the hidden
+// application data folder.
+const driveAppDataScope = "https://www.googleapis.com/auth/drive.appdata"
+
+// Spaces and corpora Files.List accepts.
+var (
+	listSpaces  = []string{"drive", "appDataFolder", "photos"}
+	listCorpora = []string{"user", "drive", "domain", "allDrives"}
+)
+
+// listScope is what Files.List calls are restricted to, from --spaces,
+// --corpora and --drive-id. The zero value leaves the API defaults.
+type listScope struct {
+	spaces  string
+	corpora string
+	driveID string
+}
+
+// parseListScope validates the --spaces list and the --corpora value.
+func parseListScope(spaces, corpora, driveID string) (listScope, error) {
+	if spaces != "" {
+		for _, s := range strings.Split(spaces, ",") {
+			if !slices.Contains(listSpaces, s) {
+				return listScope{}, fmt.Errorf("invalid --spaces %q, expected a comma separated list of %s", spaces, strings.Join(listSpaces, ", "))
+			}
+		}
+	}
+	if corpora != "" && !slices.Contains(listCorpora, corpora) {
+		return listScope{}, fmt.Errorf("invalid --corpora %q, expected one of %s", corpora, strings.Join(listCorpora, ", "))
+	}
+	if (corpora == "drive") != (driveID != "") {
+		return listScope{}, fmt.Errorf("--corpora=drive and --drive-id must be used together")
+	}
+	return listScope{spaces: spaces, corpora: corpora, driveID: driveID}, nil
+}
+
+// appData reports whether the appDataFolder space is listed, which needs
+// the drive.appdata scope.
+func (s listScope) appData() bool {
+	return slices.Contains(strings.Split(s.spaces, ","), "appDataFolder")
+}
+
+// list starts a Files.List call for query, restricted to the configured
+// spaces and corpora. Shared drive items are always included, so allDrives
+// and drive corpora work without further flags.
+func (d *downloader) list(query string) *drive.FilesListCall {
+	call := d.srv.Files.List().Q(query).PageSize(listPageSize).
+		SupportsAllDrives(true).IncludeItemsFromAllDrives(true)
+	if d.listScope.spaces != "" {
+		call = call.Spaces(d.listScope.spaces)
+	}
+	if d.listScope.corpora != "" {
+		call = call.Corpora(d.listScope.corpora)
+	}
+	if d.listScope.driveID != "" {
+		call = call.DriveId(d.listScope.driveID)
+	}
+	if d.orderBy != "" {
+		call = call.OrderBy(d.orderBy)
+	}
+	return call
+}
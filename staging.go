@@ -0,0 +1,33 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// prepareStagingDir creates the staging directory and makes sure files can
+// be renamed from it into outputDir. A rename is atomic only within one
+// filesystem, and copying across would defeat the purpose of staging.
+func prepareStagingDir(dir, outputDir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("unable to create staging directory: %v", err)
+	}
+	probe, err := os.CreateTemp(dir, ".gdrive-dl-probe-*")
+	if err != nil {
+		return fmt.Errorf("unable to write to staging directory: %v", err)
+	}
+	probe.Close()
+	moved := filepath.Join(outputDir, filepath.Base(probe.Name()))
+	err = os.Rename(probe.Name(), moved)
+	if err != nil {
+		os.Remove(probe.Name())
+		if errors.Is(err, syscall.EXDEV) {
+			return fmt.Errorf("staging directory %s is on a different filesystem than the output, files could not be moved atomically", dir)
+		}
+		return fmt.Errorf("unable to move files out of the staging directory: %v", err)
+	}
+	return os.Remove(moved)
+}
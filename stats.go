@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/api/drive/v3"
+)
+
+// stats tracks the progress of a run. The counters are shared by the final
+// summary and the --status-addr endpoint.
+type stats struct {
+	start     time.Time
+	completed atomic.Int64
+	skipped   atomic.Int64
+	failed    atomic.Int64
+	bytes     atomic.Int64 // written so far, across all files
+	expected  atomic.Int64 // sizes of every file that started downloading
+	total     atomic.Int64 // sizes of the input files, when known up front
+	apiCalls  atomic.Int64 // Drive API requests made
+
+	mu       sync.Mutex
+	inFlight map[*transfer]struct{}
+}
+
+// transfer is a single download in progress.
+type transfer struct {
+	id      string
+	path    string
+	size    int64
+	started time.Time
+	written atomic.Int64
+	stats   *stats
+	// progress, if set, is told about every chunk written. progressMu
+	// serializes the calls of the parts of a --parallel-file-parts
+	// download, and reported is the last count it was given.
+	progress   progressFunc
+	progressMu sync.Mutex
+	reported   int64
+
+	// hashes are the --stream-hash checksums of what was written,
+	// computed over the whole file as long as hashValid is set.
+	hashMu    sync.Mutex
+	hashNames []string
+	hashes    []streamHash
+	hashValid bool
+	// showHashes logs them with the progress and once the file is done.
+	showHashes bool
+}
+
+// progressFunc is called as a download is written, with the bytes written so
+// far and the size Drive reports (0 for exports, whose size is not known
+// up front). bytesSoFar only goes down when a transfer starts over from the
+// beginning. It runs on a copying goroutine, between writes, one call at a
+// time per transfer even when --parallel-file-parts writes it from several,
+// so it must be cheap and must not block; anything slow belongs on a
+// goroutine of its own.
+type progressFunc func(fileID string, bytesSoFar, totalBytes int64)
+
+func newStats() *stats {
+	return &stats{start: time.Now(), inFlight: map[*transfer]struct{}{}}
+}
+
+// begin registers a download of file to path.
+func (s *stats) begin(file *drive.File, path string) *transfer {
+	t := &transfer{id: file.Id, path: path, size: file.Size, started: time.Now(), stats: s}
+	s.expected.Add(file.Size)
+	s.mu.Lock()
+	s.inFlight[t] = struct{}{}
+	s.mu.Unlock()
+	return t
+}
+
+// end removes a finished download from the in-flight set.
+func (s *stats) end(t *transfer) {
+	s.mu.Lock()
+	delete(s.inFlight, t)
+	s.mu.Unlock()
+}
+
+// add counts n more bytes written for t.
+func (t *transfer) add(n int64) {
+	t.written.Add(n)
+	t.stats.bytes.Add(n)
+	if t.progress == nil || n <= 0 {
+		return
+	}
+	// Parts report concurrently, so a count is only passed on if no later
+	// one was already; reading it under the lock keeps them in order.
+	t.progressMu.Lock()
+	defer t.progressMu.Unlock()
+	if written := t.written.Load(); written > t.reported {
+		t.reported = written
+		t.progress(t.id, written, t.size)
+	}
+}
+
+// reset forgets the bytes written so far when a transfer starts over.
+func (t *transfer) reset() {
+	t.stats.bytes.Add(-t.written.Swap(0))
+	t.progressMu.Lock()
+	t.reported = 0
+	t.progressMu.Unlock()
+	t.hashMu.Lock()
+	t.restartHashes()
+	t.hashMu.Unlock()
+}
+
+// statusTransfer is an in-flight download as reported by the status endpoint.
+type statusTransfer struct {
+	ID      string `json:"id"`
+	Path    string `json:"path"`
+	Bytes   int64  `json:"bytes"`
+	Size    int64  `json:"size"`
+	Elapsed string `json:"elapsed"`
+}
+
+// status is the document served on --status-addr.
+type status struct {
+	InFlight       []statusTransfer `json:"in_flight"`
+	Completed      int64            `json:"completed"`
+	Skipped        int64            `json:"skipped"`
+	Failed         int64            `json:"failed"`
+	Bytes          int64            `json:"bytes"`
+	APICalls       int64            `json:"api_calls"`
+	Elapsed        string           `json:"elapsed"`
+	BytesPerSecond float64          `json:"bytes_per_second"`
+	// ETA is based on the average throughput so far and on the input files
+	// found by the pre-flight, or without it on the files that have started
+	// downloading, as the rest of the input is not known yet.
+	ETA string `json:"eta,omitempty"`
+}
+
+// snapshot returns the current state of the run.
+func (s *stats) snapshot() status {
+	now := time.Now()
+	elapsed := now.Sub(s.start)
+	st := status{
+		InFlight:  []statusTransfer{},
+		Completed: s.completed.Load(),
+		Skipped:   s.skipped.Load(),
+		Failed:    s.failed.Load(),
+		Bytes:     s.bytes.Load(),
+		APICalls:  s.apiCalls.Load(),
+		Elapsed:   elapsed.Round(time.Second).String(),
+	}
+	if secs := elapsed.Seconds(); secs > 0 {
+		st.BytesPerSecond = float64(st.Bytes) / secs
+	}
+	remaining := s.expected.Load() - st.Bytes
+	if total := s.total.Load(); total > 0 {
+		remaining = total - st.Bytes
+	}
+	if remaining > 0 && st.BytesPerSecond > 0 {
+		st.ETA = time.Duration(float64(remaining) / st.BytesPerSecond * float64(time.Second)).Round(time.Second).String()
+	}
+
+	s.mu.Lock()
+	for t := range s.inFlight {
+		st.InFlight = append(st.InFlight, statusTransfer{
+			ID:      t.id,
+			Path:    t.path,
+			Bytes:   t.written.Load(),
+			Size:    t.size,
+			Elapsed: now.Sub(t.started).Round(time.Second).String(),
+		})
+	}
+	s.mu.Unlock()
+	sort.Slice(st.InFlight, func(i, j int) bool { return st.InFlight[i].Path < st.InFlight[j].Path })
+	return st
+}
+
+// serveStatus serves the run status as JSON on addr until the process exits.
+func (s *stats) serveStatus(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.snapshot())
+	})
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Printf("Unable to serve status on %s: %v", addr, err)
+		}
+	}()
+}
+
+// logSummary logs the totals of the run.
+func (s *stats) logSummary() {
+	log.Printf("Done: %d downloaded, %d skipped, %d failed, %s in %v, %d API calls",
+		s.completed.Load(), s.skipped.Load(), s.failed.Load(), logBytes(s.bytes.Load()),
+		time.Since(s.start).Round(time.Second), s.apiCalls.Load())
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+
+	"google.golang.org/api/drive/v3"
+)
+
+// templateData is what --dir-template and --name-template can use. Every
+// value except Path is a single path component: separators in it are
+// replaced, so a file name never adds folders.
+type templateData struct {
+	ID       string
+	Name     string // the file name on Drive
+	Base     string // Name without its extension
+	Ext      string // the extension of Name, with its dot
+	MimeType string
+	// Path is the file's Drive folder path, as the default layout uses.
+	Path string
+	// Owner is the email address of the file's first owner, "unknown" for
+	// files without one, as in shared drives.
+	Owner         string
+	ModifiedYear  string
+	ModifiedMonth string
+	ModifiedDay   string
+	CreatedYear   string
+}
+
+// templateNamer names files from templates for the directory and the file
+// name, which compose into the output path. A missing template keeps that
+// part of the base layout: the Drive folder path, or none with --flatten,
+// and the file's own name.
+type templateNamer struct {
+	dir  *template.Template
+	name *template.Template
+	flat bool
+}
+
+// newTemplateNamer parses --dir-template and --name-template, either of
+// which may be empty, and tries them on a sample file so that a mistyped
+// field fails at startup rather than on the first download.
+func newTemplateNamer(dirTemplate, nameTemplate string, flat bool) (*templateNamer, error) {
+	n := &templateNamer{flat: flat}
+	var err error
+	if dirTemplate != "" {
+		if n.dir, err = template.New("dir").Option("missingkey=error").Parse(dirTemplate); err != nil {
+			return nil, fmt.Errorf("invalid --dir-template: %v", err)
+		}
+	}
+	if nameTemplate != "" {
+		if n.name, err = template.New("name").Option("missingkey=error").Parse(nameTemplate); err != nil {
+			return nil, fmt.Errorf("invalid --name-template: %v", err)
+		}
+	}
+	sample := &drive.File{Id: "sample", Name: "sample.txt", MimeType: "text/plain"}
+	if _, err := n.Name(sample, "folder"); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+func (n *templateNamer) Name(file *drive.File, folderPath string) (string, error) {
+	data := newTemplateData(file, folderPath)
+	dir := folderPath
+	if n.flat {
+		dir = ""
+	}
+	if n.dir != nil {
+		s, err := render(n.dir, data)
+		if err != nil {
+			return "", fmt.Errorf("invalid --dir-template: %v", err)
+		}
+		dir = cleanTemplatePath(s)
+	}
+	name := file.Name
+	if n.name != nil {
+		s, err := render(n.name, data)
+		if err != nil {
+			return "", fmt.Errorf("invalid --name-template: %v", err)
+		}
+		if name = templateComponent(s); name == "" {
+			return "", fmt.Errorf("--name-template gives %s an empty name", file.Id)
+		}
+	}
+	return filepath.Join(dir, name), nil
+}
+
+func render(t *template.Template, data templateData) (string, error) {
+	var b strings.Builder
+	if err := t.Execute(&b, data); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+func newTemplateData(file *drive.File, folderPath string) templateData {
+	ext := filepath.Ext(file.Name)
+	data := templateData{
+		ID:       templateComponent(file.Id),
+		Name:     templateComponent(file.Name),
+		Base:     templateComponent(strings.TrimSuffix(file.Name, ext)),
+		Ext:      templateComponent(ext),
+		MimeType: templateComponent(file.MimeType),
+		Path:     folderPath,
+		Owner:    "unknown",
+	}
+	if len(file.Owners) > 0 && file.Owners[0].EmailAddress != "" {
+		data.Owner = templateComponent(file.Owners[0].EmailAddress)
+	}
+	if t, err := time.Parse(time.RFC3339, file.ModifiedTime); err == nil {
+		data.ModifiedYear, data.ModifiedMonth, data.ModifiedDay = t.Format("2006"), t.Format("01"), t.Format("02")
+	}
+	if t, err := time.Parse(time.RFC3339, file.CreatedTime); err == nil {
+		data.CreatedYear = t.Format("2006")
+	}
+	return data
+}
+
+// templateComponent makes s usable as one path component: separators
+// become underscores, and . and .. are replaced.
+func templateComponent(s string) string {
+	s = strings.NewReplacer("/", "_", `\`, "_").Replace(strings.TrimSpace(s))
+	if s == "." || s == ".." {
+		return "_"
+	}
+	return s
+}
+
+// cleanTemplatePath turns a rendered --dir-template into a relative path
+// inside the output root, split on the slashes of the template itself.
+// Empty components, as from a field without a value, are dropped.
+func cleanTemplatePath(s string) string {
+	var parts []string
+	for _, part := range strings.Split(filepath.ToSlash(s), "/") {
+		if part = strings.TrimSpace(part); part != "" {
+			parts = append(parts, templateComponent(part))
+		}
+	}
+	return filepath.Join(parts...)
+}
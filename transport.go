@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// userAgentTransport sets a fixed User-Agent header on every request so the
+// tool can be told apart from other API clients.
+type userAgentTransport struct {
+	userAgent string
+	base      http.RoundTripper
+}
+
+func (t *userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("User-Agent", t.userAgent)
+	return t.base.RoundTrip(req)
+}
+
+// pacingTransport spaces out the requests of all goroutines by a minimum
+// interval, like a leaky bucket, so that the burst of a run's start is
+// spread out instead of being rate limited. Requests keep their slot order:
+// each one reserves the next free slot and waits for it.
+//
+// A 429 carrying Retry-After also holds back every request after it, not
+// just the retry of the one that got it.
+type pacingTransport struct {
+	interval time.Duration
+	base     http.RoundTripper
+
+	mu   sync.Mutex
+	next time.Time
+}
+
+func (t *pacingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.wait(req.Context()); err != nil {
+		return nil, err
+	}
+	resp, err := t.base.RoundTrip(req)
+	if err == nil && resp.StatusCode == http.StatusTooManyRequests {
+		if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && secs > 0 {
+			t.holdUntil(time.Now().Add(time.Duration(secs) * time.Second))
+		}
+	}
+	return resp, err
+}
+
+// wait blocks until the request's slot comes up.
+func (t *pacingTransport) wait(ctx context.Context) error {
+	t.mu.Lock()
+	now := time.Now()
+	slot := t.next
+	if slot.Before(now) {
+		slot = now
+	}
+	t.next = slot.Add(t.interval)
+	t.mu.Unlock()
+
+	timer := time.NewTimer(time.Until(slot))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// holdUntil delays every request not yet issued until at least until.
+func (t *pacingTransport) holdUntil(until time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.next.Before(until) {
+		t.next = until
+	}
+}
+
+// callCountTransport counts the API requests of the run into calls. With a
+// limit, it calls reached once the limit-th request goes out, and refuses
+// every request after it, for --max-api-calls.
+type callCountTransport struct {
+	base    http.RoundTripper
+	calls   *atomic.Int64
+	limit   int64
+	reached func()
+	once    sync.Once
+}
+
+// errAPICallLimit is returned for the requests past --max-api-calls.
+var errAPICallLimit = errors.New("--max-api-calls reached, request not sent")
+
+func (t *callCountTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	n := t.calls.Add(1)
+	if t.limit > 0 && n >= t.limit {
+		t.once.Do(t.reached)
+		if n > t.limit {
+			t.calls.Add(-1)
+			if req.Body != nil {
+				req.Body.Close()
+			}
+			return nil, errAPICallLimit
+		}
+	}
+	return t.base.RoundTrip(req)
+}
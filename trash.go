@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"google.golang.org/api/drive/v3"
+)
+
+// driveWriteScope is only requested when a destructive option needs it.
+const driveWriteScope = drive.DriveScope
+
+// trash moves a successfully downloaded file to the Drive trash, but only
+// when the local copy is verified to be complete. Native files are never
+// trashed, because their export is a conversion and not a copy of the
+// original.
+func (d *downloader) trash(ctx context.Context, file *drive.File, dest string, written int64) (bool, error) {
+	if isNative(file) {
+		log.Printf("%s: not trashing %s, exports are not exact copies", file.Id, file.Name)
+		return false, nil
+	}
+	if written != file.Size {
+		log.Printf("%s: not trashing %s, the download size could not be verified", file.Id, file.Name)
+		return false, nil
+	}
+	err := d.retry.do(ctx, file.Id, func() error {
+		_, err := d.srv.Files.Update(file.Id, &drive.File{Trashed: true}).Fields("id").SupportsAllDrives(true).Context(ctx).Do()
+		return err
+	})
+	if err != nil {
+		return false, fmt.Errorf("unable to move file to trash: %v", err)
+	}
+	log.Printf("%s: downloaded to %s and moved to the Drive trash", file.Id, dest)
+	return true, nil
+}
+
+// confirmTrash asks on the controlling terminal before files are trashed,
+// since stdin carries the list of file IDs.
+func confirmTrash() error {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("cannot ask for confirmation without a terminal, pass --yes to trash files non-interactively")
+	}
+	defer tty.Close()
+
+	fmt.Fprint(tty, "Downloaded files will be moved to the Drive trash. Type \"yes\" to continue: ")
+	answer, err := bufio.NewReader(tty).ReadString('\n')
+	if err != nil || strings.TrimSpace(answer) != "yes" {
+		return fmt.Errorf("not confirmed, nothing will be trashed")
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+
+	"google.golang.org/api/drive/v3"
+)
+
+// treeNode is a file or folder of the --dump-tree document.
+type treeNode struct {
+	ID       string      `json:"id"`
+	Name     string      `json:"name"`
+	MimeType string      `json:"mimeType"`
+	Size     int64       `json:"size,omitempty"`
+	Children []*treeNode `json:"children,omitempty"`
+}
+
+// folderTree collects the folders walked with --recursive, as they are
+// listed, so that the traversal can be saved as a nested JSON tree without
+// any further API calls.
+type folderTree struct {
+	mu    sync.Mutex
+	roots []*treeNode
+	nodes map[string]*treeNode // folders by ID
+}
+
+func newFolderTree() *folderTree {
+	return &folderTree{nodes: map[string]*treeNode{}}
+}
+
+// node returns the node of file, creating it on first use.
+func (t *folderTree) node(file *drive.File) *treeNode {
+	if n, ok := t.nodes[file.Id]; ok {
+		return n
+	}
+	n := &treeNode{ID: file.Id, Name: file.Name, MimeType: file.MimeType}
+	if file.MimeType == folderMimeType {
+		t.nodes[file.Id] = n
+	} else {
+		n.Size = file.Size
+	}
+	return n
+}
+
+// addRoot records an input folder.
+func (t *folderTree) addRoot(folder *drive.File) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.roots = append(t.roots, t.node(folder))
+}
+
+// add records a page of the listing of the folder with the given ID.
+func (t *folderTree) add(folderID string, files []*drive.File) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	parent, ok := t.nodes[folderID]
+	if !ok {
+		// A folder resumed from --state, whose own listing entry is in an
+		// earlier run.
+		parent = &treeNode{ID: folderID, MimeType: folderMimeType}
+		t.nodes[folderID] = parent
+		t.roots = append(t.roots, parent)
+	}
+	for _, f := range files {
+		parent.Children = append(parent.Children, t.node(f))
+	}
+}
+
+// write saves the tree to path, created with mode, with children sorted by
+// name so that two dumps can be diffed. complete is false when the
+// traversal did not finish.
+func (t *folderTree) write(path string, mode os.FileMode, complete bool) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, n := range t.nodes {
+		sort.SliceStable(n.Children, func(i, j int) bool {
+			a, b := n.Children[i], n.Children[j]
+			if a.Name != b.Name {
+				return a.Name < b.Name
+			}
+			return a.ID < b.ID
+		})
+	}
+	doc := struct {
+		Complete bool        `json:"complete"`
+		Roots    []*treeNode `json:"roots"`
+	}{complete, t.roots}
+	if doc.Roots == nil {
+		doc.Roots = []*treeNode{}
+	}
+	b, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return fmt.Errorf("unable to encode tree: %v", err)
+	}
+	if err := os.WriteFile(path, append(b, '\n'), mode); err != nil {
+		return fmt.Errorf("unable to write tree: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Byte count formats accepted by --bytes-format.
+const (
+	bytesHuman = "human"
+	bytesRaw   = "raw"
+)
+
+// humanLogBytes shows byte counts in log lines as e.g. "1.5 GiB" instead of
+// exact counts, and humanCatalogBytes does the same for the --catalog size
+// column. JSON output always has exact counts.
+var humanLogBytes, humanCatalogBytes = true, false
+
+// setBytesFormat applies --bytes-format, where "" keeps the defaults.
+func setBytesFormat(s string) error {
+	switch s {
+	case "":
+	case bytesHuman, bytesRaw:
+		humanLogBytes = s == bytesHuman
+		humanCatalogBytes = humanLogBytes
+	default:
+		return fmt.Errorf("invalid --bytes-format %q, expected %s or %s", s, bytesHuman, bytesRaw)
+	}
+	return nil
+}
+
+// humanBytes returns n in the largest binary unit it reaches, e.g. "512 B"
+// or "1.5 GiB".
+func humanBytes(n int64) string {
+	const unit = 1024
+	if n < unit && n > -unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	v, i := float64(n)/unit, 0
+	for (v >= unit || v <= -unit) && i < len("KMGTPE")-1 {
+		v /= unit
+		i++
+	}
+	return fmt.Sprintf("%.1f %ciB", v, "KMGTPE"[i])
+}
+
+// logBytes formats n for a log line.
+func logBytes(n int64) string {
+	if humanLogBytes {
+		return humanBytes(n)
+	}
+	return fmt.Sprintf("%d bytes", n)
+}
+
+// sizeSuffixes maps the unit suffixes accepted by parseSize to multipliers.
+// Both decimal-looking and binary spellings mean powers of 1024.
+var sizeSuffixes = []struct {
+	suffix string
+	mult   int64
+}{
+	{"tib", 1 << 40}, {"gib", 1 << 30}, {"mib", 1 << 20}, {"kib", 1 << 10},
+	{"tb", 1 << 40}, {"gb", 1 << 30}, {"mb", 1 << 20}, {"kb", 1 << 10},
+	{"t", 1 << 40}, {"g", 1 << 30}, {"m", 1 << 20}, {"k", 1 << 10},
+	{"b", 1},
+}
+
+// parseSize parses a byte count such as "512", "64K" or "1.5GiB".
+func parseSize(s string) (int64, error) {
+	v := strings.ToLower(strings.TrimSpace(s))
+	mult := int64(1)
+	for _, u := range sizeSuffixes {
+		if strings.HasSuffix(v, u.suffix) {
+			v, mult = strings.TrimSpace(strings.TrimSuffix(v, u.suffix)), u.mult
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(v, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(n * float64(mult)), nil
+}
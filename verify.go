@@ -0,0 +1,137 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+
+	"google.golang.org/api/drive/v3"
+)
+
+// Outcomes of checking a local file against Drive with --verify-only.
+const (
+	verifyOK        = "OK"
+	verifyMismatch  = "MISMATCH"
+	verifyMissing   = "MISSING"
+	verifyUnchecked = "UNCHECKED" // exports have no checksum to compare with
+)
+
+// verifyCounts tallies --verify-only outcomes for the summary.
+type verifyCounts struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func (v *verifyCounts) add(outcome string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.counts == nil {
+		v.counts = map[string]int{}
+	}
+	v.counts[outcome]++
+}
+
+// logSummary logs how many files ended up in each outcome.
+func (v *verifyCounts) logSummary() {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	log.Printf("Verified: %d ok, %d mismatched, %d missing, %d unchecked",
+		v.counts[verifyOK], v.counts[verifyMismatch], v.counts[verifyMissing], v.counts[verifyUnchecked])
+}
+
+// verifyLocal compares the local copy of file at dest with Drive's size and
+// md5 checksum, without downloading anything.
+func verifyLocal(file *drive.File, dest string) (string, error) {
+	if isNative(file) {
+		return verifyUnchecked, nil
+	}
+	info, err := os.Stat(dest)
+	if errors.Is(err, os.ErrNotExist) {
+		return verifyMissing, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("unable to check local file: %v", err)
+	}
+	if info.Size() != file.Size {
+		return verifyMismatch, nil
+	}
+	if file.Md5Checksum == "" {
+		return verifyUnchecked, nil
+	}
+	sum, err := fileMD5(dest)
+	if err != nil {
+		return "", err
+	}
+	if sum != file.Md5Checksum {
+		return verifyMismatch, nil
+	}
+	return verifyOK, nil
+}
+
+// fileMD5 returns the hex md5 digest of a local file.
+func fileMD5(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("unable to open local file: %v", err)
+	}
+	defer f.Close()
+	h := md5.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("unable to read local file: %v", err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// checksumError is a download whose md5 differs from Drive's.
+type checksumError struct {
+	got, want string
+}
+
+func (e *checksumError) Error() string {
+	return fmt.Sprintf("checksum mismatch, downloaded %s but Drive reports %s", e.got, e.want)
+}
+
+// checkMD5 compares the md5 of a completed download at path with Drive's,
+// with --verify. Exports have no checksum and are not checked. The md5
+// computed while t was written is used when it covers the whole file, and
+// the file is only read back when it does not.
+func (d *downloader) checkMD5(file *drive.File, path string, t *transfer) error {
+	if !d.verifyMD5 || isNative(file) || file.Md5Checksum == "" {
+		return nil
+	}
+	sum, ok := t.sum("md5")
+	if !ok {
+		var err error
+		if sum, err = fileMD5(path); err != nil {
+			return err
+		}
+	}
+	if sum != file.Md5Checksum {
+		return &checksumError{got: sum, want: file.Md5Checksum}
+	}
+	return nil
+}
+
+// redownloads returns how many times a download that failed its checks with
+// err is fetched again. Size mismatches are retried up to --max-retries.
+// Checksum mismatches only are with --retry-on-checksum-mismatch, at least
+// once, since they are mostly corruption on the way. Content --gunzip
+// cannot decompress never is.
+func (d *downloader) redownloads(err error) int {
+	if errors.Is(err, errNotGzip) {
+		return 0
+	}
+	var sumErr *checksumError
+	if !errors.As(err, &sumErr) {
+		return d.retry.maxRetries
+	}
+	if !d.retryMismatch {
+		return 0
+	}
+	return max(1, d.retry.maxRetries)
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
+)
+
+// folderMimeType identifies Drive folders.
+const folderMimeType = "application/vnd.google-apps.folder"
+
+// listPageSize is the number of children requested per listing page.
+const listPageSize = 1000
+
+// The state file is saved once stateSaveChanges changes have piled up, or
+// stateSaveInterval after the first one, rather than on every change, which
+// rewrote the whole frontier for each folder queued. An interrupted run
+// walks again at most the pages of the changes not saved yet.
+const (
+	stateSaveChanges  = 100
+	stateSaveInterval = 5 * time.Second
+)
+
+// walker lists folders for --recursive and feeds their contents back into
+// the pipeline. With a state file, the traversal frontier is saved as it
+// goes so that an interrupted walk resumes where it stopped.
+type walker struct {
+	p         *pipeline
+	statePath string
+
+	mu      sync.Mutex
+	state   walkState
+	running map[string]bool
+	// unsaved counts the changes to state since it was last saved, which
+	// saveTimer will save if nothing else does first.
+	unsaved   int
+	saveTimer *time.Timer
+}
+
+// walkState is the traversal frontier persisted to the --state file.
+type walkState struct {
+	// Pending maps folders not fully handled yet to the token of the page
+	// being processed ("" for the first page). A page's token is only
+	// replaced once every file on it has been handled.
+	Pending map[string]string `json:"pending"`
+	// Done lists folders whose contents have all been handled.
+	Done map[string]bool `json:"done"`
+}
+
+// newWalker loads the traversal state from statePath if it exists.
+func newWalker(p *pipeline, statePath string) (*walker, error) {
+	w := &walker{
+		p:         p,
+		statePath: statePath,
+		state:     walkState{Pending: map[string]string{}, Done: map[string]bool{}},
+		running:   map[string]bool{},
+	}
+	if statePath == "" {
+		return w, nil
+	}
+	b, err := os.ReadFile(statePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return w, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read state file: %v", err)
+	}
+	if err := json.Unmarshal(b, &w.state); err != nil {
+		return nil, fmt.Errorf("unable to parse state file %s: %v", statePath, err)
+	}
+	if w.state.Pending == nil {
+		w.state.Pending = map[string]string{}
+	}
+	if w.state.Done == nil {
+		w.state.Done = map[string]bool{}
+	}
+	return w, nil
+}
+
+// resume submits the folders an earlier run left unfinished, and returns
+// how many there were.
+func (w *walker) resume(ctx context.Context) int {
+	w.mu.Lock()
+	pending := make([]string, 0, len(w.state.Pending))
+	for id := range w.state.Pending {
+		pending = append(pending, id)
+	}
+	w.mu.Unlock()
+	if len(pending) > 0 {
+		log.Printf("Resuming the traversal of %d folders from %s", len(pending), w.statePath)
+	}
+	for _, id := range pending {
+		w.p.submit(ctx, inputEntry{id: id}, nil)
+	}
+	return len(pending)
+}
+
+// walk lists the children of a folder page by page. Files are submitted for
+// download and subfolders are walked in turn.
+func (w *walker) walk(ctx context.Context, folderID string) error {
+	token, ok := w.start(folderID)
+	if !ok {
+		return nil
+	}
+	defer w.stop(folderID)
+
+	query := fmt.Sprintf("'%s' in parents and trashed = false", folderID)
+	fields := googleapi.Field("nextPageToken,files(" + string(w.p.d.fileFields()) + ")")
+	for {
+		list, err := w.list(ctx, query, fields, token)
+		if err != nil {
+			var apiErr *googleapi.Error
+			switch {
+			case token != "" && errors.As(err, &apiErr) && apiErr.Code == http.StatusBadRequest:
+				// Saved page tokens expire, and the folder may have changed
+				// since. Listing it again is safe, files already on disk can
+				// be skipped with --skip-existing.
+				log.Printf("%s: saved listing position is no longer valid, listing the folder again", folderID)
+				token = ""
+				w.setToken(folderID, token)
+				continue
+			case errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound:
+				log.Printf("%s: folder no longer exists, skipping it", folderID)
+				w.finish(folderID)
+				return nil
+			}
+			return fmt.Errorf("unable to list folder: %v", err)
+		}
+
+		if w.p.tree != nil {
+			w.p.tree.add(folderID, list.Files)
+		}
+		var page sync.WaitGroup
+		for _, f := range list.Files {
+			if f.MimeType == folderMimeType {
+				// Recorded before this page is marked done, so an
+				// interruption never loses a subfolder.
+				w.enqueue(f.Id)
+				w.p.submit(ctx, inputEntry{id: f.Id, file: f, parent: folderID}, nil)
+				continue
+			}
+			page.Add(1)
+			w.p.submit(ctx, inputEntry{id: f.Id, file: f, parent: folderID}, page.Done)
+		}
+		page.Wait()
+		if err := w.p.start.Err(); err != nil {
+			// Stopping: the page may not be fully done, so its token is
+			// not advanced and the folder stays pending in the state.
+			return err
+		}
+
+		if list.NextPageToken == "" {
+			w.finish(folderID)
+			return nil
+		}
+		if w.p.full() {
+			// Left pending, the rest is yet to be downloaded.
+			return nil
+		}
+		token = list.NextPageToken
+		w.setToken(folderID, token)
+	}
+}
+
+// list fetches one page of a folder listing.
+func (w *walker) list(ctx context.Context, query string, fields googleapi.Field, token string) (*drive.FileList, error) {
+	if err := w.p.metaSem.Acquire(w.p.start, 1); err != nil {
+		return nil, err
+	}
+	defer w.p.metaSem.Release(1)
+
+	var list *drive.FileList
+	err := w.p.d.retry.do(ctx, query, func() (err error) {
+		list, err = w.p.d.list(query).Fields(fields).PageToken(token).Context(ctx).Do()
+		return err
+	})
+	return list, err
+}
+
+// start marks a folder as being walked and returns the page to start from.
+// It reports false if the folder is already done or being walked.
+func (w *walker) start(folderID string) (string, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.state.Done[folderID] || w.running[folderID] {
+		return "", false
+	}
+	w.running[folderID] = true
+	token, ok := w.state.Pending[folderID]
+	if !ok {
+		w.state.Pending[folderID] = ""
+		w.changed()
+	}
+	return token, true
+}
+
+// stop forgets that a folder is being walked, leaving its state as it is.
+func (w *walker) stop(folderID string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.running, folderID)
+}
+
+// enqueue records a folder that still has to be walked.
+func (w *walker) enqueue(folderID string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, ok := w.state.Pending[folderID]; !ok && !w.state.Done[folderID] {
+		w.state.Pending[folderID] = ""
+		w.changed()
+	}
+}
+
+// setToken records the page a folder listing has reached.
+func (w *walker) setToken(folderID, token string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.state.Pending[folderID] = token
+	w.changed()
+}
+
+// finish records a folder whose contents have all been handled.
+func (w *walker) finish(folderID string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.state.Pending, folderID)
+	w.state.Done[folderID] = true
+	w.changed()
+}
+
+// changed records a change to the state, saving it when enough of them
+// piled up and otherwise making sure it is saved soon. Must be called with
+// mu held.
+func (w *walker) changed() {
+	if w.statePath == "" {
+		return
+	}
+	w.unsaved++
+	if w.unsaved >= stateSaveChanges {
+		w.save()
+		return
+	}
+	if w.saveTimer == nil {
+		w.saveTimer = time.AfterFunc(stateSaveInterval, func() {
+			w.mu.Lock()
+			defer w.mu.Unlock()
+			w.flush()
+		})
+	}
+}
+
+// flush saves the changes not saved yet, if any. Must be called with mu
+// held.
+func (w *walker) flush() {
+	if w.unsaved > 0 {
+		w.save()
+	}
+}
+
+// close saves the state as the walk left it, once nothing changes it any
+// more.
+func (w *walker) close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.flush()
+}
+
+// save writes the state file atomically. Must be called with mu held.
+func (w *walker) save() {
+	if w.saveTimer != nil {
+		w.saveTimer.Stop()
+		w.saveTimer = nil
+	}
+	w.unsaved = 0
+	b, err := json.Marshal(w.state)
+	if err != nil {
+		log.Printf("Unable to encode traversal state: %v", err)
+		return
+	}
+	tmp := w.statePath + ".tmp"
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		log.Printf("Unable to save traversal state: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, w.statePath); err != nil {
+		log.Printf("Unable to save traversal state: %v", err)
+	}
+}
+
+// complete removes the state file once nothing is left pending, so the
+// next run walks the folders afresh.
+func (w *walker) complete() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.statePath == "" || len(w.state.Pending) > 0 {
+		return
+	}
+	if err := os.Remove(w.statePath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Printf("Unable to remove state file: %v", err)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// savedPending returns how many folders the state file at path lists as
+// pending, or -1 when there is no state file.
+func savedPending(t *testing.T, path string) int {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return -1
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	var state walkState
+	if err := json.Unmarshal(b, &state); err != nil {
+		t.Fatal(err)
+	}
+	return len(state.Pending)
+}
+
+func TestWalkStateSavesInBatches(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	w, err := newWalker(&pipeline{}, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range stateSaveChanges - 1 {
+		w.enqueue(fmt.Sprint("folder", i))
+	}
+	if n := savedPending(t, path); n != -1 {
+		t.Fatalf("state saved with %d folders before %d changes", n, stateSaveChanges)
+	}
+	w.enqueue("last")
+	if n := savedPending(t, path); n != stateSaveChanges {
+		t.Fatalf("state saved with %d folders, want %d", n, stateSaveChanges)
+	}
+	w.finish("last")
+	w.close()
+	if n := savedPending(t, path); n != stateSaveChanges-1 {
+		t.Errorf("state closed with %d folders, want %d", n, stateSaveChanges-1)
+	}
+}
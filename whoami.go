@@ -0,0 +1,32 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"google.golang.org/api/drive/v3"
+)
+
+// whoami writes the account the token belongs to, the scopes it was
+// authorized for and the account's storage use, for --whoami.
+func whoami(ctx context.Context, srv *drive.Service, scopes []string, w io.Writer) error {
+	about, err := srv.About.Get().Fields("user(displayName,emailAddress),storageQuota").Context(ctx).Do()
+	if err != nil {
+		return fmt.Errorf("unable to retrieve account: %v", err)
+	}
+	if u := about.User; u != nil {
+		fmt.Fprintf(w, "User:    %s <%s>\n", u.DisplayName, u.EmailAddress)
+	}
+	fmt.Fprintf(w, "Scopes:  %s\n", strings.Join(scopes, " "))
+	if q := about.StorageQuota; q != nil {
+		limit := "unlimited"
+		if q.Limit > 0 {
+			limit = logBytes(q.Limit)
+		}
+		fmt.Fprintf(w, "Storage: %s used of %s (%s by Drive files, %s in the trash)\n",
+			logBytes(q.Usage), limit, logBytes(q.UsageInDrive), logBytes(q.UsageInDriveTrash))
+	}
+	return nil
+}
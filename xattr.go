@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"log"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+)
+
+// xattrIDName is the extended attribute --xattr-id stores a file's Drive ID
+// in.
+const xattrIDName = "user.gdrive.id"
+
+// errXattrUnsupported is setting an extended attribute on a platform or
+// filesystem without them.
+var errXattrUnsupported = errors.New("extended attributes are not supported here")
+
+// xattrIDs writes the Drive IDs of downloads into their xattrIDName
+// attribute, and finds local files by it for --verify-only under roots.
+type xattrIDs struct {
+	roots []string
+
+	unsupported atomic.Bool
+	warned      sync.Once
+
+	indexOnce sync.Once
+	index     map[string]string
+}
+
+// set records fileID on the file at path. Filesystems without extended
+// attributes are warned about once, and not tried again.
+func (x *xattrIDs) set(path, fileID string) {
+	if x.unsupported.Load() {
+		return
+	}
+	err := setXattr(path, xattrIDName, fileID)
+	if errors.Is(err, errXattrUnsupported) {
+		x.warned.Do(func() {
+			log.Printf("Warning: not setting %s, %v", xattrIDName, err)
+		})
+		x.unsupported.Store(true)
+		return
+	}
+	if err != nil {
+		log.Printf("Warning: %s: unable to set %s on %s: %v", fileID, xattrIDName, path, err)
+	}
+}
+
+// find returns the local file under the output roots whose attribute holds
+// fileID. The trees are read once, on the first lookup.
+func (x *xattrIDs) find(fileID string) (string, bool) {
+	x.indexOnce.Do(func() {
+		x.index = map[string]string{}
+		for _, root := range x.roots {
+			err := filepath.WalkDir(root, func(path string, e fs.DirEntry, err error) error {
+				if err != nil || !e.Type().IsRegular() {
+					return nil
+				}
+				if id, ok := getXattr(path, xattrIDName); ok {
+					x.index[id] = path
+				}
+				return nil
+			})
+			if err != nil {
+				log.Printf("Unable to look for files by %s: %v", xattrIDName, err)
+			}
+		}
+	})
+	path, ok := x.index[fileID]
+	return path, ok
+}
+
+// outputRoots returns the folders downloads are written under: the working
+// directory, --exports-dir and the --mime-route folders, without the ones
+// inside another, which would be read twice.
+func (d *downloader) outputRoots() []string {
+	dirs := []string{"."}
+	if d.exportsDir != "" {
+		dirs = append(dirs, d.exportsDir)
+	}
+	for _, r := range d.mimeRoutes {
+		dirs = append(dirs, r.dir)
+	}
+	abs := make([]string, len(dirs))
+	for i, dir := range dirs {
+		var err error
+		if abs[i], err = filepath.Abs(dir); err != nil {
+			abs[i] = filepath.Clean(dir)
+		}
+	}
+	var roots []string
+	for i, dir := range dirs {
+		inside := false
+		for j := range dirs {
+			rel, err := filepath.Rel(abs[j], abs[i])
+			if j != i && err == nil && filepath.IsLocal(rel) && (rel != "." || j < i) {
+				inside = true
+				break
+			}
+		}
+		if !inside {
+			roots = append(roots, dir)
+		}
+	}
+	return roots
+}
@@ -0,0 +1,12 @@
+//go:build !linux && !darwin
+
+package main
+
+// Extended attributes are not supported on this platform.
+func setXattr(path, name, value string) error {
+	return errXattrUnsupported
+}
+
+func getXattr(path, name string) (string, bool) {
+	return "", false
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestOutputRoots(t *testing.T) {
+	t.Chdir(t.TempDir())
+	exports := t.TempDir()
+	d := &downloader{
+		exportsDir: exports,
+		mimeRoutes: []mimeRoute{{"image/*", "images"}, {"*", "."}},
+	}
+	if got, want := d.outputRoots(), []string{".", exports}; !slices.Equal(got, want) {
+		t.Errorf("output roots %v, want %v", got, want)
+	}
+}
+
+func TestFindByXattrOutsideWorkingDirectory(t *testing.T) {
+	t.Chdir(t.TempDir())
+	d := &downloader{exportsDir: t.TempDir()}
+	path := filepath.Join(d.exportsDir, "A", "Notes.docx")
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte("docx"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := setXattr(path, xattrIDName, "doc"); errors.Is(err, errXattrUnsupported) {
+		t.Skip(err)
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	x := &xattrIDs{roots: d.outputRoots()}
+	if got, ok := x.find("doc"); !ok || got != path {
+		t.Errorf("found %q (%v), want %s", got, ok, path)
+	}
+}
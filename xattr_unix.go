@@ -0,0 +1,28 @@
+//go:build linux || darwin
+
+package main
+
+import (
+	"errors"
+
+	"golang.org/x/sys/unix"
+)
+
+// setXattr sets the extended attribute name of path to value.
+func setXattr(path, name, value string) error {
+	err := unix.Setxattr(path, name, []byte(value), 0)
+	if errors.Is(err, unix.ENOTSUP) || errors.Is(err, unix.EOPNOTSUPP) {
+		return errXattrUnsupported
+	}
+	return err
+}
+
+// getXattr returns the extended attribute name of path, if it is set.
+func getXattr(path, name string) (string, bool) {
+	buf := make([]byte, 256)
+	n, err := unix.Getxattr(path, name, buf)
+	if err != nil {
+		return "", false
+	}
+	return string(buf[:n]), true
+}